@@ -1,91 +1,179 @@
 package charmodel
 
-import "strings"
+import "math"
 import . "github.com/conlang-software-dev/Logopoeist/types"
 
-type ngrams map[string]*CharSet
-
 type CharModel struct {
-	conds ngrams
-	excls ngrams
+	byLast       map[ID][]*patternRule // rules indexed by the phonemes their last element matches
+	unindexed    []*patternRule        // rules ending in a wildcard or gap
+	nrules       int
+	restrictions []*restriction
+	tiers        []*tierRule
+	temp         float64
+	mode         int
+	gweight      float64 // influence of the grammar in CombineGeometric
+	nweight      float64 // influence of the n-grams in CombineGeometric
+	precedence   int
 }
 
 func NewModel() *CharModel {
 	return &CharModel{
-		conds: make(ngrams),
-		excls: make(ngrams),
+		byLast:     make(map[ID][]*patternRule),
+		temp:       1,
+		mode:       CombineProduct,
+		gweight:    1,
+		nweight:    1,
+		precedence: PrecedenceIntersect,
 	}
 }
 
-func (m *CharModel) AddCondition(ngram string, dist *CharSet) {
-	if ndist, ok := m.conds[ngram]; ok {
-		// copy the old map in case it was shared,
-		union := make(CharSet, len(*ndist))
-		m.conds[ngram] = &union
-		for k, v := range *ndist {
-			union[k] = v
-		}
+// SetTemperature flattens (temp > 1) or sharpens (temp < 1) the weights that
+// conditional rules give phonemes from now on. The syntax model's weights are
+// left alone; the caller tempers its grammar instead.
+func (m *CharModel) SetTemperature(temp float64) {
+	m.temp = temp
+}
 
-		// then union with the current distribution
-		for k, v := range *dist {
-			if _, ok := union[k]; ok {
-				union[k] += v
-			} else {
-				union[k] = v
-			}
+// RuleInfo holds the optional attributes of a condition or exclusion rule.
+type RuleInfo struct {
+	Scope    uint64  // 0 if the rule applies everywhere
+	Priority float64 // only used with PrecedencePriority
+	Source   string  // the rule as written, for Explain
+}
+
+// AddCondition adds a conditional distribution for the phonemes that follow
+// any context matching the pattern, in the scope given by info, or
+// everywhere if it is 0. With PrecedenceIntersect, the distributions of
+// rules with the same scope and length that match the same context are
+// unioned; all others are intersected.
+func (m *CharModel) AddCondition(info RuleInfo, pattern Pattern, dist *CharSet) {
+	m.add(&patternRule{RuleInfo: info, pattern: pattern, cond: dist})
+}
+
+// AddExclusion forbids the phonemes in dist from following any context
+// matching the pattern, in the scope given by info, or everywhere if it is 0.
+func (m *CharModel) AddExclusion(info RuleInfo, pattern Pattern, dist *Bitset) {
+	m.add(&patternRule{RuleInfo: info, pattern: pattern, excl: dist})
+}
+
+// AddBoost multiplies the weight of each phoneme in factors that follows any
+// context matching the pattern by its weight in factors, in the scope given
+// by info, or everywhere if it is 0. Other phonemes are left alone.
+func (m *CharModel) AddBoost(info RuleInfo, pattern Pattern, factors *CharSet) {
+	m.add(&patternRule{RuleInfo: info, pattern: pattern, boost: factors})
+}
+
+// Permits checks whether the conditions in the given set of scopes allow the
+// phoneme c to follow the context.
+func (m *CharModel) Permits(scope uint64, context []ID, c ID) bool {
+	conds, excl, _ := m.matching(context, func(r *patternRule) bool {
+		return r.Scope == 0 || r.Scope&scope != 0
+	})
+	if excl.Has(c) {
+		return false
+	}
+	for _, cdist := range conds {
+		if !cdist.Has(c) {
+			return false
 		}
-	} else {
-		m.conds[ngram] = dist
 	}
+	return true
 }
 
-func (m *CharModel) AddExclusion(ngram string, dist *CharSet) {
-	if edist, ok := m.excls[ngram]; ok {
+// EndWeight finds the factor by which conditions in the given set of scopes
+// scale the chance of ending the word after the given context; it is 0 if an
+// exclusion forbids it. Only conditions that list the boundary, `_`, in their
+// distributions apply.
+func (m *CharModel) EndWeight(context []ID, scope uint64) float64 {
+	conds, excl, boosts := m.matching(context, func(r *patternRule) bool {
+		return r.Scope == 0 || r.Scope&scope != 0
+	})
+	if excl.Has(WordBoundary) {
+		return 0
+	}
+	weight := 1.0
+	for _, cdist := range append(conds, boosts...) {
+		if cdist.Has(WordBoundary) {
+			weight *= cdist.Weights[WordBoundary]
+		}
+	}
 
-		// create a new map in case the original was shared
-		union := make(CharSet, len(*edist))
-		m.excls[ngram] = &union
+	if m.mode == CombineGrammar {
+		return 1 // n-gram weights only filter
+	}
+	return math.Pow(weight, 1/m.temp)
+}
+
+func (m *CharModel) CalcDistribution(base *CharSet, context []ID) *CharSet {
+	return m.calc(base, context, 0)
+}
 
-		for k := range *edist {
-			union[k] = 0
+// CalcScoped is like CalcDistribution, but the syntax model's distribution
+// is split by the set of scopes active for each phoneme (as bits, in the
+// same form as AddCondition's scope), and each part is conditioned by
+// the rules in its own scopes before they are added together.
+func (m *CharModel) CalcScoped(bases map[uint64]*CharSet, context []ID) *CharSet {
+	var sum *CharSet
+	for scope, base := range bases {
+		ndist := m.calc(base, context, scope)
+		if sum == nil {
+			sum = ndist
+			continue
 		}
-		for k := range *dist {
-			union[k] = 0
+		for char, ok := ndist.Members.Next(0); ok; char, ok = ndist.Members.Next(char + 1) {
+			sum.Add(char, ndist.Weights[char])
 		}
-	} else {
-		// reference a single common object as much as possible
-		m.excls[ngram] = dist
 	}
+	if sum == nil {
+		return &CharSet{}
+	}
+	return sum
 }
 
-func (m *CharModel) CalcDistribution(base *CharSet, context []string) CharSet {
-	ndist := make(CharSet, len(*base))
-	for k, v := range *base {
-		ndist[k] = v
-	}
+func (m *CharModel) calc(base *CharSet, context []ID, scope uint64) *CharSet {
+	ndist := base.Copy()
 
-	// iterate over conditioning ngrams
-	order := len(context)
-	for j := order; j > 0; j-- {
-		ngram := strings.Join(context[order-j:order], "")
+	conds, excl, boosts := m.matching(context, func(r *patternRule) bool {
+		return r.Scope == 0 || r.Scope&scope != 0
+	})
 
-		// remove any exclusions
-		if edist, ok := m.excls[ngram]; ok {
-			for char, _ := range *edist {
-				delete(ndist, char)
-			}
+	// n-gram weights are kept separately until they are combined with the
+	// grammar's; nil means no condition has applied, i.e. uniform
+	var nweights []float64
+	if len(conds) > 0 || len(boosts) > 0 {
+		nweights = make([]float64, len(ndist.Weights))
+		for i := range nweights {
+			nweights[i] = 1
 		}
+	}
 
-		// intersect with conditional distributions
-		if cdist, ok := m.conds[ngram]; ok {
-			for char, nweight := range ndist {
-				if cweight, ok := (*cdist)[char]; ok {
-					ndist[char] = nweight * cweight
-				} else {
-					delete(ndist, char)
-				}
+	ndist.Members.Subtract(excl)
+	for _, cdist := range conds {
+		ndist.Members.Intersect(cdist.Members)
+		for char, ok := ndist.Members.Next(0); ok; char, ok = ndist.Members.Next(char + 1) {
+			nweights[char] *= cdist.Weights[char]
+		}
+	}
+	for _, bdist := range boosts {
+		for char, ok := ndist.Members.Next(0); ok; char, ok = ndist.Members.Next(char + 1) {
+			if bdist.Has(char) {
+				nweights[char] *= bdist.Weights[char]
 			}
 		}
 	}
+	m.restrict(ndist, context)
+
+	m.temper(nweights)
+	m.combine(ndist, base, nweights)
+	m.applyTiers(ndist, context)
 	return ndist
 }
+
+// temper applies the temperature to the n-gram weights.
+func (m *CharModel) temper(nweights []float64) {
+	if m.temp != 1 {
+		for i, w := range nweights {
+			nweights[i] = math.Pow(w, 1/m.temp)
+		}
+	}
+}
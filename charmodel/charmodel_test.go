@@ -0,0 +1,189 @@
+package charmodel
+
+import "math"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// ids interns a list of phonemes.
+func ids(inv *Inventory, phonemes ...string) []ID {
+	list := make([]ID, len(phonemes))
+	for i, ph := range phonemes {
+		list[i] = inv.Intern(ph)
+	}
+	return list
+}
+
+// pattern makes a pattern matching a sequence of phonemes.
+func pattern(inv *Inventory, phonemes ...string) Pattern {
+	p := make(Pattern, len(phonemes))
+	for i, k := range ids(inv, phonemes...) {
+		p[i].Class.Add(k)
+	}
+	return p
+}
+
+// uniform makes a distribution giving each phoneme a weight of 1.
+func uniform(inv *Inventory, phonemes ...string) *CharSet {
+	dist := NewCharSet(inv.Len())
+	for _, k := range ids(inv, phonemes...) {
+		dist.Add(k, 1)
+	}
+	return dist
+}
+
+// Contexts are sequences of phonemes, so a multigraph never matches the
+// phonemes that spell it, or vice versa.
+func TestDigraphContexts(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"t", "s", "ts", "a", "bc", "ab", "c"}
+	ids(inv, all...)
+
+	m := NewModel()
+	m.AddCondition(RuleInfo{}, pattern(inv, "t", "s"), uniform(inv, "a"))
+	m.AddCondition(RuleInfo{}, pattern(inv, "a", "bc"), uniform(inv, "c"))
+	base := uniform(inv, all...)
+
+	tests := []struct {
+		context []string
+		want    int // the number of phonemes allowed
+	}{
+		{[]string{"_", "t", "s"}, 1},
+		{[]string{"_", "ts"}, len(all)},
+		{[]string{"_", "t", "ts"}, len(all)},
+		{[]string{"_", "a", "bc"}, 1},
+		{[]string{"_", "ab", "c"}, len(all)},
+	}
+	for _, test := range tests {
+		dist := m.CalcDistribution(base, ids(inv, test.context...))
+		if got := dist.Len(); got != test.want {
+			t.Errorf("after %v: %d phonemes allowed, want %d", test.context, got, test.want)
+		}
+	}
+}
+
+// Only rules that mention the boundary change the chance of ending a word.
+func TestEndWeight(t *testing.T) {
+	inv := NewInventory()
+	ids(inv, "a", "n", "h", "t", "p")
+	ending := uniform(inv, "_", "p")
+	ending.Weights[WordBoundary] = 2
+
+	tests := []struct {
+		temp    float64
+		mode    int
+		context []string
+		want    float64
+	}{
+		{1, CombineProduct, []string{"_", "a", "n"}, 2},
+		{1, CombineProduct, []string{"_", "a", "h"}, 0},
+		{1, CombineProduct, []string{"_", "a", "t"}, 1},
+		{1, CombineProduct, []string{"_", "a"}, 1},
+		{2, CombineProduct, []string{"_", "a", "n"}, math.Sqrt2},
+		{1, CombineGrammar, []string{"_", "a", "n"}, 1},
+		{1, CombineGrammar, []string{"_", "a", "h"}, 0},
+	}
+	for _, test := range tests {
+		m := NewModel()
+		m.SetTemperature(test.temp)
+		m.SetCombination(test.mode, 1, 1)
+		m.AddCondition(RuleInfo{}, pattern(inv, "n"), ending)
+		m.AddExclusion(RuleInfo{}, pattern(inv, "h"), &uniform(inv, "_").Members)
+		m.AddCondition(RuleInfo{}, pattern(inv, "t"), uniform(inv, "p"))
+		got := m.EndWeight(ids(inv, test.context...), 0)
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("temperature %g, mode %d, after %v: end weight %v, want %v",
+				test.temp, test.mode, test.context, got, test.want)
+		}
+	}
+}
+
+// Rules with a scope only apply to the phonemes, and the word ends, in parses
+// where that scope is active.
+func TestScopedRules(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "n", "m", "p"}
+	ids(inv, all...)
+	const onset, coda = 1, 2
+	ending := uniform(inv, "_", "p")
+	ending.Weights[WordBoundary] = 3
+
+	m := NewModel()
+	m.AddExclusion(RuleInfo{Scope: coda, Source: "in $Coda: <a> !> <m>"}, pattern(inv, "a"), &uniform(inv, "m").Members)
+	m.AddCondition(RuleInfo{Scope: coda, Source: "in $Coda: <n> -> <_ *3 p>"}, pattern(inv, "n"), ending)
+	m.AddCondition(RuleInfo{Source: "<p> -> <a>"}, pattern(inv, "p"), uniform(inv, "a"))
+	base := uniform(inv, all...)
+	m_, _ := inv.Lookup("m")
+
+	after := ids(inv, "_", "p", "a")
+	if !m.Permits(onset, after, m_) || m.Permits(coda, after, m_) || m.Permits(onset|coda, after, m_) {
+		t.Errorf("<m> after <a> is not forbidden in codas only")
+	}
+	dist := m.CalcScoped(map[uint64]*CharSet{onset: base, coda: base}, after)
+	if got := dist.Weight(m_); got != 1 {
+		t.Errorf("weight of <m> after <a> = %v, want 1, from the onset only", got)
+	}
+
+	end := ids(inv, "_", "p", "a", "n")
+	if got := m.EndWeight(end, coda); got != 3 {
+		t.Errorf("end weight in a coda = %v, want 3", got)
+	}
+	if got := m.EndWeight(end, onset); got != 1 {
+		t.Errorf("end weight in an onset = %v, want 1", got)
+	}
+
+	if got := m.Explain(ids(inv, "_", "p"), onset); len(got) != 1 || got[0] != "<p> -> <a>" {
+		t.Errorf("rules in an onset after <p>: %v", got)
+	}
+	if got := m.Explain(after, onset); len(got) != 0 {
+		t.Errorf("rules in an onset after <a>: %v, want none", got)
+	}
+	if got := m.Explain(after, coda); len(got) != 1 {
+		t.Errorf("rules in a coda after <a>: %v, want the exclusion", got)
+	}
+}
+
+// Boosts scale the phonemes they list and leave the others alone, and never
+// exclude anything.
+func TestBoosts(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "n", "p", "t", "k"}
+	ids(inv, all...)
+	base := uniform(inv, all...)
+	half := uniform(inv, "p", "t", "k")
+	for _, k := range ids(inv, "p", "t", "k") {
+		half.Weights[k] = 0.5
+	}
+	double := uniform(inv, "t")
+	double.Weights[inv.Intern("t")] = 2
+
+	m := NewModel()
+	// <n> *> <p t k> *0.5
+	m.AddBoost(RuleInfo{}, pattern(inv, "n"), half)
+	// <a> <n> *> <t> *2
+	m.AddBoost(RuleInfo{}, pattern(inv, "a", "n"), double)
+	// <n> -> <a *2 p t k n>
+	cond := uniform(inv, all...)
+	cond.Weights[inv.Intern("a")] = 2
+	m.AddCondition(RuleInfo{}, pattern(inv, "n", "n"), cond)
+
+	tests := []struct {
+		context []string
+		want    map[string]float64
+	}{
+		{[]string{"_", "n"}, map[string]float64{"a": 1, "n": 1, "p": 0.5, "t": 0.5, "k": 0.5}},
+		{[]string{"_", "a", "n"}, map[string]float64{"a": 1, "n": 1, "p": 0.5, "t": 1, "k": 0.5}},
+		{[]string{"_", "n", "n"}, map[string]float64{"a": 2, "n": 1, "p": 0.5, "t": 0.5, "k": 0.5}},
+		{[]string{"_", "a"}, map[string]float64{"a": 1, "n": 1, "p": 1, "t": 1, "k": 1}},
+	}
+	for _, test := range tests {
+		dist := m.CalcDistribution(base, ids(inv, test.context...))
+		if dist.Len() != len(all) {
+			t.Errorf("after %v: %d phonemes allowed, want %d", test.context, dist.Len(), len(all))
+		}
+		for ph, want := range test.want {
+			if got := dist.Weight(inv.Intern(ph)); math.Abs(got-want) > 1e-9 {
+				t.Errorf("after %v: weight of %s = %v, want %v", test.context, ph, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package charmodel
+
+import "math"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+const ( // Combination Modes
+	CombineProduct   = iota // multiply grammar and n-gram weights
+	CombineGeometric        // weighted geometric mean of grammar and n-gram weights
+	CombineGrammar          // grammar weights only; n-grams only filter
+	CombineNgram            // n-gram weights only; the grammar only filters
+	CombineMaxEnt           // product, with filtered-out mass spread evenly
+)
+
+// SetCombination selects how the syntax model's distribution is combined
+// with the n-gram model's. gweight and nweight are the relative influence of
+// each model in CombineGeometric, and are ignored otherwise.
+func (m *CharModel) SetCombination(mode int, gweight float64, nweight float64) {
+	m.mode = mode
+	m.gweight = gweight
+	m.nweight = nweight
+}
+
+// combine replaces the grammar weights of the phonemes in dist with their
+// combined weights. base is the grammar distribution before any n-gram
+// filtering, and nweights are the n-gram weights, or nil if uniform.
+func (m *CharModel) combine(dist *CharSet, base *CharSet, nweights []float64) {
+	nweight := func(char ID) float64 {
+		if nweights == nil {
+			return 1
+		}
+		return nweights[char]
+	}
+
+	switch m.mode {
+	case CombineProduct:
+		for char, ok := dist.Members.Next(0); ok; char, ok = dist.Members.Next(char + 1) {
+			dist.Weights[char] *= nweight(char)
+		}
+	case CombineGeometric:
+		total := m.gweight + m.nweight
+		for char, ok := dist.Members.Next(0); ok; char, ok = dist.Members.Next(char + 1) {
+			dist.Weights[char] = math.Pow(dist.Weights[char], m.gweight/total) *
+				math.Pow(nweight(char), m.nweight/total)
+		}
+	case CombineGrammar:
+		// the grammar weights are already in place
+	case CombineNgram:
+		for char, ok := dist.Members.Next(0); ok; char, ok = dist.Members.Next(char + 1) {
+			dist.Weights[char] = nweight(char)
+		}
+	case CombineMaxEnt:
+		// The share of the grammar's distribution that survives filtering is
+		// divided up by the product of the two models, as usual, but the
+		// share that was filtered out is divided evenly, rather than in
+		// proportion, between the remaining phonemes.
+		btotal := base.Total()
+		kept := 0.0
+		ptotal := 0.0
+		for char, ok := dist.Members.Next(0); ok; char, ok = dist.Members.Next(char + 1) {
+			kept += dist.Weights[char]
+			dist.Weights[char] *= nweight(char)
+			ptotal += dist.Weights[char]
+		}
+		count := float64(dist.Len())
+		if btotal <= 0 || ptotal <= 0 || count == 0 {
+			return
+		}
+		kept /= btotal
+		for char, ok := dist.Members.Next(0); ok; char, ok = dist.Members.Next(char + 1) {
+			dist.Weights[char] = kept*dist.Weights[char]/ptotal + (1-kept)/count
+		}
+	}
+}
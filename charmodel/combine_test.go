@@ -0,0 +1,62 @@
+package charmodel
+
+import "math"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// The grammar gives <a> 3, <b> 1 and <c> 4, and a condition that applies
+// everywhere gives <a> 1 and <b> 3, leaving out <c>.
+func TestCombination(t *testing.T) {
+	inv := NewInventory()
+	a, b, c := inv.Intern("a"), inv.Intern("b"), inv.Intern("c")
+	base := NewCharSet(inv.Len())
+	base.Add(a, 3)
+	base.Add(b, 1)
+	base.Add(c, 4)
+	cond := NewCharSet(inv.Len())
+	cond.Add(a, 1)
+	cond.Add(b, 3)
+
+	tests := []struct {
+		mode             int
+		gweight, nweight float64
+		a, b             float64
+	}{
+		{CombineProduct, 1, 1, 3, 3},
+		{CombineGeometric, 1, 1, math.Sqrt(3), math.Sqrt(3)},
+		{CombineGeometric, 1, 3, math.Pow(3, 0.25), math.Pow(3, 0.75)},
+		{CombineGrammar, 1, 1, 3, 1},
+		{CombineNgram, 1, 1, 1, 3},
+		// half of the grammar's weight is kept, in the proportions of the
+		// product, and the half that went to <c> is split evenly
+		{CombineMaxEnt, 1, 1, 0.5, 0.5},
+	}
+	for _, test := range tests {
+		m := NewModel()
+		m.SetCombination(test.mode, test.gweight, test.nweight)
+		m.AddCondition(RuleInfo{}, Pattern{}, cond)
+		dist := m.CalcDistribution(base, []ID{WordBoundary})
+		if dist.Has(c) {
+			t.Errorf("mode %d: <c> is allowed", test.mode)
+		}
+		if math.Abs(dist.Weight(a)-test.a) > 1e-9 || math.Abs(dist.Weight(b)-test.b) > 1e-9 {
+			t.Errorf("mode %d (%g:%g): weights %v, %v; want %v, %v", test.mode,
+				test.gweight, test.nweight, dist.Weight(a), dist.Weight(b), test.a, test.b)
+		}
+	}
+
+	// without any condition, every mode but CombineNgram keeps the grammar's
+	// proportions
+	for _, mode := range []int{CombineProduct, CombineGrammar, CombineMaxEnt} {
+		m := NewModel()
+		m.SetCombination(mode, 1, 1)
+		dist := m.CalcDistribution(base, []ID{WordBoundary})
+		for _, k := range []ID{a, b, c} {
+			got := dist.Weight(k) / dist.Total()
+			if want := base.Weight(k) / base.Total(); math.Abs(got-want) > 1e-9 {
+				t.Errorf("mode %d: share of %s = %v without conditions, want %v",
+					mode, inv.Name(k), got, want)
+			}
+		}
+	}
+}
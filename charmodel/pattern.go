@@ -0,0 +1,171 @@
+package charmodel
+
+import "sort"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+const ( // Pattern Element Kinds
+	MatchClass = iota // any phoneme in a class
+	MatchAny          // any single phoneme, but not the word boundary
+	MatchGap          // any sequence of phonemes, including none
+)
+
+// Element is one position in a Pattern. Class is only used by MatchClass.
+type Element struct {
+	Kind  int
+	Class Bitset
+}
+
+// Pattern is a sequence of elements that is matched against the end of a
+// context, for rules that cannot be expanded into a finite set of n-grams.
+type Pattern []Element
+
+// Matches checks whether the pattern matches the end of the context.
+func (p Pattern) Matches(context []ID) bool {
+	return p.match(len(p)-1, context, len(context)-1)
+}
+
+// match checks whether p[:i+1] matches the end of context[:j+1].
+func (p Pattern) match(i int, context []ID, j int) bool {
+	for ; i >= 0; i-- {
+		e := p[i]
+		if e.Kind == MatchGap {
+			// try the shortest gaps first
+			for k := j; k >= -1; k-- {
+				if p.match(i-1, context, k) {
+					return true
+				}
+			}
+			return false
+		}
+		if j < 0 {
+			return false
+		}
+		switch e.Kind {
+		case MatchAny:
+			if context[j] == WordBoundary {
+				return false
+			}
+		case MatchClass:
+			if !e.Class.Has(context[j]) {
+				return false
+			}
+		}
+		j--
+	}
+	return true
+}
+
+// patternRule is a condition or exclusion rule.
+type patternRule struct {
+	RuleInfo
+	pattern     Pattern
+	length      int // the number of phonemes matched, or -1 if there is a gap
+	specificity int // the number of elements that are not gaps
+	id          int
+	cond        *CharSet
+	excl        *Bitset
+	boost       *CharSet
+}
+
+// groupKey identifies the conditions that are unioned, rather than
+// intersected, when they match the same context: those with the same scope
+// and the same length, which must match exactly the same phonemes. Rules
+// with gaps are never grouped.
+type groupKey struct {
+	scope  uint64
+	length int
+	id     int
+}
+
+func (m *CharModel) add(r *patternRule) {
+	r.id = m.nrules
+	m.nrules++
+
+	r.length = len(r.pattern)
+	r.specificity = len(r.pattern)
+	for _, e := range r.pattern {
+		if e.Kind == MatchGap {
+			r.length = -1
+			r.specificity--
+		}
+	}
+
+	if len(r.pattern) == 0 || r.pattern[len(r.pattern)-1].Kind != MatchClass {
+		m.unindexed = append(m.unindexed, r)
+		return
+	}
+	last := r.pattern[len(r.pattern)-1].Class
+	for c, ok := last.Next(0); ok; c, ok = last.Next(c + 1) {
+		m.byLast[c] = append(m.byLast[c], r)
+	}
+}
+
+// matching finds the rules selected by use that match the end of the
+// context and take precedence, and returns the distributions of the
+// conditions, unioned within each group, the union of the exclusions, and
+// the factors of the boosts. The distributions must not be modified.
+func (m *CharModel) matching(context []ID, use func(r *patternRule) bool) ([]*CharSet, Bitset, []*CharSet) {
+	var conds []*CharSet
+	var owned []bool // whether each of conds is a copy that may be modified
+	var groups map[groupKey]int
+	var excl Bitset
+	var boosts []*CharSet
+
+	for _, r := range m.winners(context, use) {
+		if r.excl != nil {
+			excl.Union(*r.excl)
+			continue
+		}
+		if r.boost != nil {
+			boosts = append(boosts, r.boost)
+			continue
+		}
+
+		key := groupKey{scope: r.Scope, length: r.length}
+		if r.length < 0 {
+			key.id = r.id
+		}
+		i, ok := groups[key]
+		if !ok {
+			if groups == nil {
+				groups = make(map[groupKey]int)
+			}
+			groups[key] = len(conds)
+			conds = append(conds, r.cond)
+			owned = append(owned, false)
+			continue
+		}
+		if !owned[i] {
+			conds[i] = conds[i].Copy()
+			owned[i] = true
+		}
+		for k, ok := r.cond.Members.Next(0); ok; k, ok = r.cond.Members.Next(k + 1) {
+			conds[i].Add(k, r.cond.Weights[k])
+		}
+	}
+	return conds, excl, boosts
+}
+
+// matches finds every rule selected by use that matches the end of the
+// context, in the order in which they were added.
+func (m *CharModel) matches(context []ID, use func(r *patternRule) bool) []*patternRule {
+	var found []*patternRule
+	visit := func(r *patternRule) {
+		if use(r) && r.pattern.Matches(context) {
+			found = append(found, r)
+		}
+	}
+
+	if len(context) > 0 {
+		for _, r := range m.byLast[context[len(context)-1]] {
+			visit(r)
+		}
+	}
+	for _, r := range m.unindexed {
+		visit(r)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].id < found[j].id
+	})
+	return found
+}
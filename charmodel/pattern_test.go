@@ -0,0 +1,149 @@
+package charmodel
+
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+func TestPatternMatches(t *testing.T) {
+	inv := NewInventory()
+	ids(inv, "a", "i", "p", "t", "k")
+	class := func(phonemes ...string) Element {
+		return Element{Kind: MatchClass, Class: uniform(inv, phonemes...).Members}
+	}
+	any := Element{Kind: MatchAny}
+	gap := Element{Kind: MatchGap}
+	vowel := class("a", "i")
+
+	tests := []struct {
+		pattern Pattern
+		context []string
+		want    bool
+	}{
+		// #V * matches a vowel and then any one phoneme
+		{Pattern{vowel, any}, []string{"_", "a", "p"}, true},
+		{Pattern{vowel, any}, []string{"_", "p", "a", "t"}, true},
+		{Pattern{vowel, any}, []string{"_", "a"}, false},
+		{Pattern{vowel, any}, []string{"_", "p", "t"}, false},
+		// the wildcard never matches the boundary
+		{Pattern{any}, []string{"_"}, false},
+		{Pattern{any, vowel}, []string{"_", "a"}, false},
+		// _ ... <a> matches an <a> anywhere before the end, after any gap
+		{Pattern{class("_"), gap, class("a")}, []string{"_", "a"}, true},
+		{Pattern{class("_"), gap, class("a")}, []string{"_", "p", "t", "a"}, true},
+		{Pattern{class("_"), gap, class("a")}, []string{"_", "a", "p"}, false},
+		// a gap at the end lets anything follow
+		{Pattern{class("a"), gap}, []string{"_", "a", "p", "t"}, true},
+		{Pattern{class("a"), gap}, []string{"_", "a"}, true},
+		{Pattern{class("a"), gap}, []string{"_", "p", "t"}, false},
+		// gaps in the middle can be empty, or long
+		{Pattern{class("p"), gap, class("t"), any}, []string{"_", "p", "t", "a"}, true},
+		{Pattern{class("p"), gap, class("t"), any}, []string{"_", "p", "a", "k", "t", "i"}, true},
+		{Pattern{class("p"), gap, class("t"), any}, []string{"_", "t", "p", "i"}, false},
+	}
+	for i, test := range tests {
+		if got := test.pattern.Matches(ids(inv, test.context...)); got != test.want {
+			t.Errorf("test %d: matches %v = %v, want %v", i, test.context, got, test.want)
+		}
+	}
+}
+
+// Rules ending in a wildcard or gap are not indexed by their last phoneme,
+// but are still found.
+func TestUnindexedRules(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "i", "p", "t"}
+	ids(inv, all...)
+	vowel := Element{Kind: MatchClass, Class: uniform(inv, "a", "i").Members}
+
+	m := NewModel()
+	// #V * -> <a>
+	m.AddCondition(RuleInfo{}, Pattern{vowel, {Kind: MatchAny}}, uniform(inv, "a"))
+	// <i> ... !> <t>
+	m.AddExclusion(RuleInfo{}, append(pattern(inv, "i"), Element{Kind: MatchGap}), &uniform(inv, "t").Members)
+	base := uniform(inv, all...)
+
+	tests := []struct {
+		context []string
+		want    int
+	}{
+		{[]string{"_", "a", "p"}, 1},
+		{[]string{"_", "p", "a"}, 4},
+		{[]string{"_", "i", "p", "p"}, 3},
+		{[]string{"_", "i", "p"}, 1},
+	}
+	for _, test := range tests {
+		if got := m.CalcDistribution(base, ids(inv, test.context...)).Len(); got != test.want {
+			t.Errorf("after %v: %d phonemes allowed, want %d", test.context, got, test.want)
+		}
+	}
+}
+
+// A rule over large classes is stored once, indexed by the phonemes of its
+// last class, rather than as every n-gram it matches.
+func TestLazyRules(t *testing.T) {
+	inv := NewInventory()
+	consonants := strings.Fields("p t k b d g m n s z f v l r h j w c q x y ts dz ch sh")
+	vowels := strings.Fields("a e i o u ai au ei")
+	ids(inv, consonants...)
+	ids(inv, vowels...)
+	C := Element{Kind: MatchClass, Class: uniform(inv, consonants...).Members}
+	V := Element{Kind: MatchClass, Class: uniform(inv, vowels...).Members}
+
+	m := NewModel()
+	// #C #V #C #V -> <p>
+	m.AddCondition(RuleInfo{}, Pattern{C, V, C, V}, uniform(inv, "p"))
+	if m.nrules != 1 || len(m.unindexed) != 0 || len(m.byLast) != len(vowels) {
+		t.Errorf("%d rules, %d unindexed, indexed by %d phonemes; want 1, 0, %d",
+			m.nrules, len(m.unindexed), len(m.byLast), len(vowels))
+	}
+
+	base := uniform(inv, append(consonants, vowels...)...)
+	tests := []struct {
+		context []string
+		want    int
+	}{
+		{[]string{"_", "sh", "ai", "x", "u"}, 1},
+		{[]string{"_", "a", "ts", "ei", "d", "o"}, 1},
+		{[]string{"_", "a", "ts", "ei", "d"}, len(consonants) + len(vowels)},
+		{[]string{"_", "ts", "ei", "o"}, len(consonants) + len(vowels)},
+	}
+	for _, test := range tests {
+		if got := m.CalcDistribution(base, ids(inv, test.context...)).Len(); got != test.want {
+			t.Errorf("after %v: %d phonemes allowed, want %d", test.context, got, test.want)
+		}
+	}
+}
+
+// Conditions of the same length that match the same context are unioned, as
+// when they were stored as n-grams, while conditions of different lengths
+// are intersected.
+func TestConditionGroups(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "i", "p", "t", "k"}
+	ids(inv, all...)
+	base := uniform(inv, all...)
+
+	m := NewModel()
+	m.AddCondition(RuleInfo{}, pattern(inv, "a"), uniform(inv, "p"))
+	m.AddCondition(RuleInfo{}, pattern(inv, "a"), uniform(inv, "t"))
+	m.AddCondition(RuleInfo{}, pattern(inv, "i", "a"), uniform(inv, "t", "k"))
+
+	tests := []struct {
+		context []string
+		want    []string
+	}{
+		{[]string{"_", "p", "a"}, []string{"p", "t"}},
+		{[]string{"_", "i", "a"}, []string{"t"}},
+	}
+	for _, test := range tests {
+		dist := m.CalcDistribution(base, ids(inv, test.context...))
+		if dist.Len() != len(test.want) {
+			t.Errorf("after %v: %d phonemes allowed, want %v", test.context, dist.Len(), test.want)
+		}
+		for _, k := range ids(inv, test.want...) {
+			if !dist.Has(k) {
+				t.Errorf("after %v: %s not allowed", test.context, inv.Name(k))
+			}
+		}
+	}
+}
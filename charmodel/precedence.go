@@ -0,0 +1,56 @@
+package charmodel
+
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+const ( // Precedence Modes
+	PrecedenceIntersect = iota // every matching rule applies
+	PrecedenceBackoff          // only the matching rules with the longest contexts apply
+	PrecedencePriority         // only the matching rules with the highest priority apply
+)
+
+// SetPrecedence selects which of the condition and exclusion rules that
+// match a context are applied to it.
+func (m *CharModel) SetPrecedence(mode int) {
+	m.precedence = mode
+}
+
+// winners finds the rules selected by use that match the end of the context
+// and take precedence over the rest.
+func (m *CharModel) winners(context []ID, use func(r *patternRule) bool) []*patternRule {
+	found := m.matches(context, use)
+	if m.precedence == PrecedenceIntersect || len(found) < 2 {
+		return found
+	}
+
+	rank := func(r *patternRule) float64 {
+		if m.precedence == PrecedenceBackoff {
+			return float64(r.specificity)
+		}
+		return r.Priority
+	}
+	best := rank(found[0])
+	for _, r := range found[1:] {
+		if rank(r) > best {
+			best = rank(r)
+		}
+	}
+	winners := found[:0]
+	for _, r := range found {
+		if rank(r) == best {
+			winners = append(winners, r)
+		}
+	}
+	return winners
+}
+
+// Explain lists the sources of the condition and exclusion rules that apply
+// after the context, in the given set of scopes.
+func (m *CharModel) Explain(context []ID, scope uint64) []string {
+	var sources []string
+	for _, r := range m.winners(context, func(r *patternRule) bool {
+		return r.Scope == 0 || r.Scope&scope != 0
+	}) {
+		sources = append(sources, r.Source)
+	}
+	return sources
+}
@@ -0,0 +1,50 @@
+package charmodel
+
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// A general rule and two more specific ones with the same context, which tie
+// under backoff and are unioned.
+func TestPrecedence(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "i", "p", "t", "k", "b"}
+	ids(inv, all...)
+	base := uniform(inv, all...)
+
+	tests := []struct {
+		mode    int
+		context []string
+		want    string // the phonemes allowed
+		rules   string // the rules Explain lists
+	}{
+		{PrecedenceIntersect, []string{"_", "i", "a"}, "t", "<a>; <i> <a>; <i> <a> *"},
+		{PrecedenceBackoff, []string{"_", "i", "a"}, "t k b", "<i> <a>; <i> <a> *"},
+		{PrecedencePriority, []string{"_", "i", "a"}, "p t", "<a>"},
+		{PrecedenceIntersect, []string{"_", "p", "a"}, "p t", "<a>"},
+		{PrecedenceBackoff, []string{"_", "p", "a"}, "p t", "<a>"},
+		{PrecedencePriority, []string{"_", "p", "a"}, "p t", "<a>"},
+	}
+	for _, test := range tests {
+		m := NewModel()
+		m.SetPrecedence(test.mode)
+		m.AddCondition(RuleInfo{Priority: 1, Source: "<a>"}, pattern(inv, "a"), uniform(inv, "p", "t"))
+		m.AddCondition(RuleInfo{Source: "<i> <a>"}, pattern(inv, "i", "a"), uniform(inv, "k", "t"))
+		m.AddCondition(RuleInfo{Source: "<i> <a> *"}, pattern(inv, "i", "a"), uniform(inv, "b"))
+
+		context := ids(inv, test.context...)
+		dist := m.CalcDistribution(base, context)
+		want := strings.Fields(test.want)
+		if dist.Len() != len(want) {
+			t.Errorf("mode %d, after %v: %d phonemes allowed, want %v", test.mode, test.context, dist.Len(), want)
+		}
+		for _, k := range ids(inv, want...) {
+			if !dist.Has(k) {
+				t.Errorf("mode %d, after %v: %s not allowed", test.mode, test.context, inv.Name(k))
+			}
+		}
+		if got := strings.Join(m.Explain(context, 0), "; "); got != test.rules {
+			t.Errorf("mode %d, after %v: Explain = %q, want %q", test.mode, test.context, got, test.rules)
+		}
+	}
+}
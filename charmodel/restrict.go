@@ -0,0 +1,82 @@
+package charmodel
+
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// restriction constrains the phoneme in a target position by the phonemes on
+// both sides of it. Since words are generated from left to right, a
+// restriction is only checked once the last phoneme of its right context is
+// chosen; a choice that would complete the context around a forbidden target
+// is filtered out, so the generator backtracks out of the target instead.
+type restriction struct {
+	target Bitset
+	dist   Bitset
+	keep   bool // whether targets must be in dist (->), or must not be (!>)
+	left   []Bitset
+	right  []Bitset
+}
+
+// AddRestriction adds a rule that a phoneme from target, preceded by one from
+// each of the left classes in order and followed by one from each of the
+// right classes, must be a member of dist; or, if keep is false, must not be.
+func (m *CharModel) AddRestriction(target Bitset, dist Bitset, keep bool, left []Bitset, right []Bitset) {
+	m.restrictions = append(m.restrictions, &restriction{
+		target: target,
+		dist:   dist,
+		keep:   keep,
+		left:   left,
+		right:  right,
+	})
+}
+
+// allows checks whether the phoneme c is permitted in the target position of r.
+func (r *restriction) allows(c ID) bool {
+	return !r.target.Has(c) || r.dist.Has(c) == r.keep
+}
+
+// matches checks whether the classes in ctx match the phonemes in word,
+// starting at position i.
+func matches(ctx []Bitset, word []ID, i int) bool {
+	if i < 0 || i+len(ctx) > len(word) {
+		return false
+	}
+	for k, cset := range ctx {
+		if !cset.Has(word[i+k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// restrict removes every phoneme from dist that would break a restriction if
+// it came after the context.
+func (m *CharModel) restrict(dist *CharSet, context []ID) {
+	for _, r := range m.restrictions {
+		if len(r.right) == 0 {
+			// the next phoneme is itself the target
+			if !matches(r.left, context, len(context)-len(r.left)) {
+				continue
+			}
+			for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+				if !r.allows(c) {
+					dist.Delete(c)
+				}
+			}
+			continue
+		}
+
+		// the next phoneme would complete the right context
+		last := len(r.right) - 1
+		i := len(context) - last - 1
+		if i < 1 || r.allows(context[i]) ||
+			!matches(r.left, context, i-len(r.left)) ||
+			!matches(r.right[:last], context, i+1) {
+			continue
+		}
+		cset := r.right[last]
+		for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+			if cset.Has(c) {
+				dist.Delete(c)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package charmodel
+
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// A restriction is checked when the last phoneme of its environment is
+// chosen, by leaving out the phonemes that would complete it around a
+// forbidden target.
+func TestRestrictions(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "i", "n", "m", "p", "b", "t", "k"}
+	ids(inv, all...)
+	set := func(phonemes ...string) Bitset {
+		return uniform(inv, phonemes...).Members
+	}
+
+	m := NewModel()
+	// #N -> <m> / _ <p b>
+	m.AddRestriction(set("n", "m"), set("m"), true, nil, []Bitset{set("p", "b")})
+	// <i> !> <i> / <t> _
+	m.AddRestriction(set("i"), set("i"), false, []Bitset{set("t")}, nil)
+	// #V !> <i> / <t> _ #C <a>
+	m.AddRestriction(set("a", "i"), set("i"), false, []Bitset{set("t")}, []Bitset{set("p", "t", "k"), set("a")})
+	base := uniform(inv, all...)
+
+	tests := []struct {
+		context   []string
+		forbidden []string
+	}{
+		{[]string{"_", "a", "n"}, []string{"p", "b"}},
+		{[]string{"_", "a", "m"}, nil},
+		{[]string{"_", "t"}, []string{"i"}},
+		{[]string{"_", "k"}, nil},
+		{[]string{"_", "t", "i", "k"}, []string{"a"}},
+		{[]string{"_", "t", "a", "k"}, nil},
+		{[]string{"_", "p", "i", "k"}, nil},
+	}
+	for _, test := range tests {
+		dist := m.CalcDistribution(base, ids(inv, test.context...))
+		forbidden := make(map[string]bool)
+		for _, ph := range test.forbidden {
+			forbidden[ph] = true
+		}
+		for _, ph := range all {
+			k, _ := inv.Lookup(ph)
+			if dist.Has(k) == forbidden[ph] {
+				t.Errorf("after %v: allowed(%s) = %v", test.context, ph, dist.Has(k))
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package charmodel
+
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// tierRule is a condition or exclusion whose context is matched against only
+// the phonemes on a tier (for example, just the vowels), skipping over any
+// others, and which only applies to the next phoneme if it is on the tier.
+type tierRule struct {
+	tier Bitset
+	ctx  Pattern  // matched against the phonemes on the tier
+	cond *CharSet // nil for exclusions
+	excl Bitset
+}
+
+// AddTierCondition adds a conditional distribution for the phonemes of tier
+// that follow the phonemes matching ctx on that tier. The word boundary
+// counts as part of every tier, so a ctx beginning with a class containing
+// only WordBoundary matches the first phonemes of the tier in the word.
+func (m *CharModel) AddTierCondition(tier Bitset, ctx Pattern, dist *CharSet) {
+	m.tiers = append(m.tiers, &tierRule{tier: tier, ctx: ctx, cond: dist})
+}
+
+// AddTierExclusion forbids the phonemes of tier in dist from following the
+// phonemes matching ctx on that tier.
+func (m *CharModel) AddTierExclusion(tier Bitset, ctx Pattern, dist Bitset) {
+	m.tiers = append(m.tiers, &tierRule{tier: tier, ctx: ctx, excl: dist})
+}
+
+// matches checks whether the phonemes of context on r's tier match r's
+// conditioning pattern.
+func (r *tierRule) matches(context []ID) bool {
+	tiered := make([]ID, 0, len(context))
+	for _, c := range context {
+		if c == WordBoundary || r.tier.Has(c) {
+			tiered = append(tiered, c)
+		}
+	}
+	return r.ctx.Matches(tiered)
+}
+
+// applyTiers filters and reweights the phonemes in dist by every tier rule
+// that matches the context. Conditions only choose between the phonemes on
+// the tier: their total weight is preserved, so a tier condition never makes
+// it more or less likely that the next phoneme is on the tier at all, unless
+// it excludes every one of them.
+func (m *CharModel) applyTiers(dist *CharSet, context []ID) {
+	for _, r := range m.tiers {
+		if !r.matches(context) {
+			continue
+		}
+
+		if r.cond == nil {
+			for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+				if r.tier.Has(c) && r.excl.Has(c) {
+					dist.Delete(c)
+				}
+			}
+			continue
+		}
+
+		before := 0.0
+		after := 0.0
+		for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+			if !r.tier.Has(c) {
+				continue
+			}
+			before += dist.Weights[c]
+			if !r.cond.Has(c) {
+				dist.Delete(c)
+				continue
+			}
+			if m.mode != CombineGrammar {
+				dist.Weights[c] *= r.cond.Weights[c]
+			}
+			after += dist.Weights[c]
+		}
+		if after <= 0 {
+			continue
+		}
+		for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+			if r.tier.Has(c) {
+				dist.Weights[c] *= before / after
+			}
+		}
+	}
+}
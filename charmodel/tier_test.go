@@ -0,0 +1,52 @@
+package charmodel
+
+import "math"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// Tier rules look back past phonemes off the tier, and only decide between
+// the phonemes on it, keeping their total weight.
+func TestTiers(t *testing.T) {
+	inv := NewInventory()
+	all := []string{"a", "o", "e", "i", "p", "t"}
+	ids(inv, all...)
+	vowels := uniform(inv, "a", "o", "e", "i").Members
+	base := uniform(inv, all...)
+	front := uniform(inv, "e", "i")
+	front.Weights[inv.Intern("i")] = 3
+
+	harmony := NewModel()
+	// on #V: #Front -> <e i *3>
+	harmony.AddTierCondition(vowels, Pattern{{Class: front.Members}}, front)
+	// on #V: #Back !> #Front
+	back := uniform(inv, "a", "o").Members
+	harmony.AddTierExclusion(vowels, Pattern{{Class: back}}, front.Members)
+
+	first := NewModel()
+	// on #V: _ -> <a>
+	first.AddTierCondition(vowels, pattern(inv, "_"), uniform(inv, "a"))
+
+	tests := []struct {
+		m       *CharModel
+		context []string
+		want    map[string]float64 // the weights of the phonemes allowed
+	}{
+		{harmony, []string{"_", "e", "p", "t"}, map[string]float64{"e": 1, "i": 3, "p": 1, "t": 1}},
+		{harmony, []string{"_", "a", "p"}, map[string]float64{"a": 1, "o": 1, "p": 1, "t": 1}},
+		{harmony, []string{"_", "p"}, map[string]float64{"a": 1, "o": 1, "e": 1, "i": 1, "p": 1, "t": 1}},
+		{first, []string{"_", "p", "t"}, map[string]float64{"a": 4, "p": 1, "t": 1}},
+		{first, []string{"_", "a", "p"}, map[string]float64{"a": 1, "o": 1, "e": 1, "i": 1, "p": 1, "t": 1}},
+	}
+	for _, test := range tests {
+		dist := test.m.CalcDistribution(base, ids(inv, test.context...))
+		if dist.Len() != len(test.want) {
+			t.Errorf("after %v: %d phonemes allowed, want %d", test.context, dist.Len(), len(test.want))
+		}
+		for ph, want := range test.want {
+			k, _ := inv.Lookup(ph)
+			if got := dist.Weight(k); math.Abs(got-want) > 1e-9 {
+				t.Errorf("after %v: weight of %s = %v, want %v", test.context, ph, got, want)
+			}
+		}
+	}
+}
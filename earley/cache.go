@@ -0,0 +1,102 @@
+package earley
+
+import "sync"
+import "container/list"
+import "encoding/binary"
+import . "github.com/conlang-software-dev/Logopoeist/grammar"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+import . "github.com/conlang-software-dev/Logopoeist/environment"
+
+func tokenKey(token ID) string {
+	var buf [binary.MaxVarintLen32]byte
+	return string(buf[:binary.PutUvarint(buf[:], uint64(token))])
+}
+
+// cacheKey identifies a parser level by the maximum length of its root and
+// the phoneme prefix that produced it.
+type cacheKey struct {
+	max    int
+	prefix string
+}
+
+// Cache holds a bounded number of parser levels, keyed by the phoneme prefix
+// that produced them, so that words sharing a prefix do not have to be
+// parsed again. Processed levels are immutable, so a Cache may be shared
+// between goroutines.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	root    *EarleyParser
+	bounded map[int]*EarleyParser // roots for each maximum length
+	entries map[cacheKey]*list.Element
+	recent  *list.List // least recently used levels are at the back
+}
+
+func NewCache(env *Environment, g Grammar, root string, scopes map[string]uint64, size int) *Cache {
+	return &Cache{
+		size:    size,
+		root:    NewParser(env, g, root, scopes),
+		bounded: make(map[int]*EarleyParser),
+		entries: make(map[cacheKey]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// Root returns the parser level for the empty prefix.
+func (c *Cache) Root() *EarleyParser {
+	return c.root
+}
+
+// Within returns the parser level for the empty prefix that only keeps
+// states for words of at most max phonemes, as in EarleyParser.Within. If
+// max is 0, it is the same as Root.
+func (c *Cache) Within(max int) *EarleyParser {
+	if max <= 0 {
+		return c.root
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.bounded[max]
+	if !ok {
+		p = c.root.Within(max)
+		c.bounded[max] = p
+	}
+	return p
+}
+
+// Next is equivalent to p.Next(token), but reuses a cached level if possible.
+// p must have been derived from c.Root() or c.Within().
+func (c *Cache) Next(p *EarleyParser, token ID) (*EarleyParser, bool) {
+	return c.NextIn(p, token, nil)
+}
+
+// NextIn is equivalent to p.NextIn(token, allowed), but reuses a cached level
+// if possible. Levels are cached by prefix alone, so allowed must always
+// give the same results for the same prefix.
+func (c *Cache) NextIn(p *EarleyParser, token ID, allowed func(scope uint64) bool) (*EarleyParser, bool) {
+	key := cacheKey{p.max, p.prefix + tokenKey(token)}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.recent.MoveToFront(e)
+		c.mu.Unlock()
+		np := e.Value.(*EarleyParser)
+		return np, !np.IsEmpty()
+	}
+	c.mu.Unlock()
+
+	// Parse without holding the lock; if another goroutine got here first,
+	// both results are equivalent, and only one is kept.
+	np, ok := p.NextIn(token, allowed)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.recent.PushFront(np)
+		for c.recent.Len() > c.size {
+			old := c.recent.Remove(c.recent.Back()).(*EarleyParser)
+			delete(c.entries, cacheKey{old.max, old.prefix})
+		}
+	}
+	return np, ok
+}
@@ -0,0 +1,91 @@
+package earley
+
+import "sync"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+func TestCacheHits(t *testing.T) {
+	env, g := syllableGrammar(2)
+	c := NewCache(env, g, "W", nil, 10)
+	p := env.Phonemes.Intern("p")
+	a := env.Phonemes.Intern("a")
+
+	np, ok := c.Next(c.Root(), p)
+	if !ok {
+		t.Fatalf("<p> rejected")
+	}
+	if again, _ := c.Next(c.Root(), p); again != np {
+		t.Errorf("the level for <p> was parsed again")
+	}
+	direct, _ := c.Root().Next(p)
+	if len(direct.column) != len(np.column) {
+		t.Errorf("cached level has %d states, want %d", len(np.column), len(direct.column))
+	}
+
+	// a longer prefix is cached separately from its parent
+	npa, _ := c.Next(np, a)
+	if again, _ := c.Next(np, a); again != npa || npa == np {
+		t.Errorf("the level for <p><a> was not cached separately")
+	}
+
+	// rejected prefixes are cached as well
+	if _, ok := c.Next(np, p); ok {
+		t.Errorf("<p><p> accepted")
+	}
+	if _, ok := c.Next(np, p); ok {
+		t.Errorf("<p><p> accepted from the cache")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	env, g := syllableGrammar(2)
+	c := NewCache(env, g, "W", nil, 2)
+	var tokens []ID
+	for _, ph := range []string{"p", "t", "k"} {
+		tokens = append(tokens, env.Phonemes.Intern(ph))
+	}
+
+	first, _ := c.Next(c.Root(), tokens[0])
+	second, _ := c.Next(c.Root(), tokens[1])
+	c.Next(c.Root(), tokens[0]) // <p> is now more recent than <t>
+	c.Next(c.Root(), tokens[2]) // so <t> is evicted
+
+	if c.recent.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("cache holds %d levels, want 2", c.recent.Len())
+	}
+	if np, _ := c.Next(c.Root(), tokens[0]); np != first {
+		t.Errorf("the most recently used level was evicted")
+	}
+	if np, _ := c.Next(c.Root(), tokens[1]); np == second {
+		t.Errorf("the least recently used level was not evicted")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	env, g := syllableGrammar(4)
+	c := NewCache(env, g, "W", nil, 8)
+	var word []ID
+	for _, ph := range []string{"p", "a", "t", "p", "o", "k"} {
+		word = append(word, env.Phonemes.Intern(ph))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := c.Root()
+			for _, k := range word {
+				var ok bool
+				if p, ok = c.Next(p, k); !ok {
+					t.Errorf("word rejected at %s", env.Phonemes.Name(k))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if c.recent.Len() != len(word) {
+		t.Errorf("cache holds %d levels, want %d", c.recent.Len(), len(word))
+	}
+}
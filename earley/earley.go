@@ -7,6 +7,7 @@ import . "github.com/conlang-software-dev/Logopoeist/environment"
 
 type state struct {
 	lhs      string
+	rule     int // index into the RuleSet for lhs; -1 for terminals
 	rhs      []*Node
 	dot      uint
 	start    uint
@@ -22,43 +23,72 @@ func (s *state) needNonTerminal() bool {
 	return s.rhs[s.dot].Type == SVar
 }
 
-func (s *state) equals(other *state) bool {
-	if s.terminal != other.terminal ||
-		s.lhs != other.lhs ||
-		s.dot != other.dot ||
-		s.start != other.start {
-		return false
+// key identifies a state within a column, so that duplicate states can be
+// merged without scanning the whole column.
+func (s *state) key() stateKey {
+	return stateKey{
+		lhs:      s.lhs,
+		rule:     s.rule,
+		dot:      s.dot,
+		start:    s.start,
+		terminal: s.terminal,
 	}
-	if len(s.rhs) != len(other.rhs) {
-		return false
-	}
-	for i, n := range s.rhs {
-		o := other.rhs[i]
-		if n.Type != o.Type || n.Value != o.Value {
-			return false
-		}
-	}
-	return true
+}
+
+type stateKey struct {
+	lhs      string
+	rule     int
+	dot      uint
+	start    uint
+	terminal bool
+}
+
+// symbol identifies the term after the dot of an incomplete state.
+type symbol struct {
+	Type  int
+	Value string
 }
 
 type EarleyParser struct {
 	parent   *EarleyParser
 	level    uint
 	synmodel Grammar
-	env      Environment
+	env      *Environment
 	root     string
+	nulls    map[string]float64
 	column   []*state
+	index    map[stateKey]*state
+	waiting  map[symbol][]*state
+	yields   map[string]Yield
+	rests    map[string]Yield // remaining length after each predicted symbol
+	scopes   map[string]uint64
+	actives  map[string]map[uint64]float64 // scopes above each predicted symbol
+	blocked  map[*state]bool               // states in the last column that cannot take the token
+	slots    []*slot
+	allowed  *CharSet // AllowedTokens, when every slot fits the length bounds
+	fits     Yield
+	prefix   string // encoding of the tokens consumed to reach this level
+	max      int    // states that can only finish longer words are dropped; 0 if unbounded
 	finished bool
 }
 
-func NewParser(env Environment, g Grammar, root string) *EarleyParser {
+// NewParser creates a parser for the words derived from root. scopes maps
+// the names of syntax variables (as "$name") and character classes (as
+// "#name") to distinct bits, which are used to tell ScopedTokens which of
+// them are active; it may be nil.
+func NewParser(env *Environment, g Grammar, root string, scopes map[string]uint64) *EarleyParser {
 	np := &EarleyParser{
 		parent:   nil,
 		level:    0,
 		env:      env,
 		synmodel: g,
 		root:     root,
+		nulls:    g.Nullable(),
+		yields:   g.Yields(),
+		scopes:   scopes,
 		column:   []*state{},
+		index:    make(map[stateKey]*state),
+		waiting:  make(map[symbol][]*state),
 		finished: false,
 	}
 
@@ -73,21 +103,65 @@ func newLevel(p *EarleyParser) *EarleyParser {
 		env:      p.env,
 		synmodel: p.synmodel,
 		root:     p.root,
+		nulls:    p.nulls,
+		yields:   p.yields,
+		scopes:   p.scopes,
+		max:      p.max,
 		column:   []*state{},
+		index:    make(map[stateKey]*state),
+		waiting:  make(map[symbol][]*state),
 		finished: false,
 	}
 }
 
+// Within returns a new parser for the same words as the root level p, except
+// that it never keeps a state that could only finish a word longer than max
+// phonemes, rather than just leaving it out of AllowedTokens.
+func (p *EarleyParser) Within(max int) *EarleyParser {
+	np := &EarleyParser{
+		parent:   nil,
+		level:    0,
+		env:      p.env,
+		synmodel: p.synmodel,
+		root:     p.root,
+		nulls:    p.nulls,
+		yields:   p.yields,
+		scopes:   p.scopes,
+		max:      max,
+		column:   []*state{},
+		index:    make(map[stateKey]*state),
+		waiting:  make(map[symbol][]*state),
+		finished: false,
+	}
+
+	np.init()
+	return np
+}
+
+// room checks whether rhs, started in this column, could be finished within
+// the parser's maximum length, not counting whatever must follow it.
+func (p *EarleyParser) room(rhs []*Node) bool {
+	if p.max <= 0 {
+		return true
+	}
+	y, ok := p.synmodel.Yield(rhs, p.yields)
+	return ok && int(p.level)+y.Min <= p.max
+}
+
 func (p *EarleyParser) init() {
 	if rset, ok := p.synmodel.Rules(p.root); ok {
 		for i, rhs := range rset.Rules {
+			if !p.room(rhs) {
+				continue
+			}
 			p.addToChart(&state{
 				lhs:      p.root,
+				rule:     i,
 				rhs:      rhs,
 				dot:      0,
 				start:    0,
 				terminal: false,
-				weight:   rset.Weights[i],
+				weight:   rset.Prob(i),
 			})
 		}
 	}
@@ -103,23 +177,28 @@ func (p *EarleyParser) IsEmpty() bool {
 }
 
 func (p *EarleyParser) addToChart(s *state) {
-	for _, old := range p.column {
-		if s.equals(old) {
-			old.weight += s.weight
-			return
-		}
+	k := s.key()
+	if old, ok := p.index[k]; ok {
+		old.weight += s.weight
+		return
 	}
+	p.index[k] = s
 	p.column = append(p.column, s)
+	if !s.iscomplete() {
+		term := s.rhs[s.dot]
+		sym := symbol{term.Type, term.Value}
+		p.waiting[sym] = append(p.waiting[sym], s)
+	}
 }
 
-func (p *EarleyParser) getColumn(index uint) []*state {
+func (p *EarleyParser) getLevel(index uint) *EarleyParser {
 	for p.level > index {
 		p = p.parent
 	}
-	return p.column
+	return p
 }
 
-func (chart *EarleyParser) scan(s *state, token string) {
+func (chart *EarleyParser) scan(s *state, token ID, allowed func(uint64) bool) {
 	if s.iscomplete() {
 		return
 	}
@@ -134,14 +213,38 @@ func (chart *EarleyParser) scan(s *state, token string) {
 		return
 	}
 
+	if chart.max > 0 {
+		// s must be able to finish the word after the token
+		rest, ok := chart.parent.restAfter(s)
+		if !ok || int(chart.level)+rest.Min > chart.max {
+			chart.blocked[s] = true
+			return
+		}
+	}
+
 	if chars.Contains(token) {
+		weight := s.weight
+		if allowed != nil {
+			// keep only the share of s in which the token is allowed
+			weight = 0
+			for scope, share := range chart.active(s, chart.scopes["#"+term.Value]) {
+				if allowed(scope) {
+					weight += s.weight * share
+				}
+			}
+			if weight == 0 {
+				chart.blocked[s] = true
+				return
+			}
+		}
 		chart.addToChart(&state{
 			lhs:      term.Value,
+			rule:     -1,
 			rhs:      []*Node{}, // could store the token here, but it's not necessary for our purposes
 			dot:      1,         // 0 would work as well, since rhs is empty; the point is to make this state "finished"
 			start:    chart.level - 1,
 			terminal: true,
-			weight:   s.weight,
+			weight:   weight,
 		})
 	}
 }
@@ -154,38 +257,67 @@ func (chart *EarleyParser) predict(s *state) {
 	}
 	if rset, ok := g.Rules(term.Value); ok {
 		for i, rhs := range rset.Rules {
+			if !chart.room(rhs) {
+				continue
+			}
 			chart.addToChart(&state{
 				lhs:      term.Value,
+				rule:     i,
 				rhs:      rhs,
 				dot:      0,
 				start:    chart.level,
 				terminal: false,
-				weight:   s.weight * rset.Weights[i],
+				weight:   s.weight * rset.Prob(i),
 			})
 		}
 	}
+
+	// A nullable symbol may already have been completed in this column
+	// before s was added, so skip over it right away (Aycock & Horspool).
+	if nweight, ok := chart.nulls[term.Value]; ok {
+		chart.addToChart(&state{
+			lhs:      s.lhs,
+			rule:     s.rule,
+			rhs:      s.rhs,
+			dot:      s.dot + 1,
+			start:    s.start,
+			terminal: false,
+			weight:   s.weight * nweight,
+		})
+	}
 }
 
 func (chart *EarleyParser) complete(s *state) {
-	for _, old := range chart.getColumn(s.start) {
-		if old.iscomplete() {
-			continue
-		}
-		term := old.rhs[old.dot]
-		t := SVar
-		if s.terminal {
-			t = CVar
+	if s.start == chart.level && !s.terminal {
+		return // empty completions are handled by predict
+	}
+	t := SVar
+	if s.terminal {
+		t = CVar
+	}
+	waiting := chart.getLevel(s.start).waiting[symbol{t, s.lhs}]
+
+	// s was predicted or scanned from all of the waiting states at once, so
+	// each of them takes back its own share of s's weight
+	total := 0.0
+	for _, old := range waiting {
+		if !s.terminal || !chart.blocked[old] {
+			total += old.weight
 		}
-		if term.Type == t && term.Value == s.lhs {
-			chart.addToChart(&state{
-				lhs:      old.lhs,
-				rhs:      old.rhs,
-				dot:      old.dot + 1,
-				start:    old.start,
-				terminal: false,
-				weight:   s.weight,
-			})
+	}
+	for _, old := range waiting {
+		if s.terminal && chart.blocked[old] || total == 0 {
+			continue
 		}
+		chart.addToChart(&state{
+			lhs:      old.lhs,
+			rule:     old.rule,
+			rhs:      old.rhs,
+			dot:      old.dot + 1,
+			start:    old.start,
+			terminal: false,
+			weight:   s.weight * old.weight / total,
+		})
 	}
 }
 
@@ -203,18 +335,38 @@ func (p *EarleyParser) process() {
 		}
 	}
 	//optional: filter out completed states to save memory
+
+	// The column is never altered after this point, so it can be shared
+	// freely between goroutines.
+	p.index = nil
+	p.blocked = nil
+	p.calcRests()
+	p.calcScopes()
+	p.calcSlots()
 }
 
-func (p *EarleyParser) Next(token string) (*EarleyParser, bool) {
+func (p *EarleyParser) Next(token ID) (*EarleyParser, bool) {
+	return p.NextIn(token, nil)
+}
+
+// NextIn is like Next, but only accepts the token in slots where allowed
+// returns true for the set of scopes that are active, as in ScopedTokens.
+// If allowed is nil, the token is accepted in every slot.
+func (p *EarleyParser) NextIn(token ID, allowed func(scope uint64) bool) (*EarleyParser, bool) {
 	np := newLevel(p)
+	np.prefix = p.prefix + tokenKey(token)
+	np.blocked = make(map[*state]bool)
 	for _, s := range p.column {
-		np.scan(s, token)
+		np.scan(s, token, allowed)
 	}
 
 	np.process()
 	return np, len(np.column) > 0
 }
 
+// TerminationProbability gives the odds of ending the word here against going
+// on. Only states waiting on a character class count towards going on, since
+// the states that predicted them would otherwise be counted twice.
 func (p *EarleyParser) TerminationProbability() float64 {
 	done_weight := 0.0
 	cont_weight := 0.0
@@ -223,34 +375,143 @@ func (p *EarleyParser) TerminationProbability() float64 {
 			if s.start == 0 && s.lhs == p.root {
 				done_weight += s.weight
 			}
-		} else {
+		} else if s.rhs[s.dot].Type == CVar {
 			cont_weight += s.weight
 		}
 	}
 	return done_weight / cont_weight
 }
 
-func (p *EarleyParser) AllowedTokens() *CharSet {
-	cset := make(CharSet)
-	for _, s := range p.column {
-		if s.iscomplete() {
+// AllowedTokens returns the weighted set of phonemes that could come next,
+// in words with lengths between min and max (or unbounded, if max is 0).
+// The result must not be modified by the caller.
+func (p *EarleyParser) AllowedTokens(min int, max int) *CharSet {
+	if p.fits.Max >= min && (max <= 0 || p.fits.Min <= max) {
+		return p.allowed
+	}
+
+	cset := NewCharSet(p.env.Phonemes.Len())
+	for _, sl := range p.slots {
+		if sl.length.Max >= min && (max <= 0 || sl.length.Min <= max) {
+			sl.addTo(cset)
+		}
+	}
+	return cset
+}
+
+// slot collects the states in a column that are waiting on the same
+// character class, and could complete words in the same range of lengths.
+type slot struct {
+	class  *CharClass
+	length Yield
+	scope  uint64
+	weight float64
+}
+
+func (sl *slot) addTo(cset *CharSet) {
+	for _, k := range sl.class.List {
+		cset.Add(k, sl.class.Weights.Weight(k)*sl.weight)
+	}
+}
+
+type slotKey struct {
+	class  string
+	length Yield
+	scope  uint64
+}
+
+// calcRests finds, for every syntax variable predicted in this column, the
+// range of the number of phonemes that must follow it to finish the word.
+func (p *EarleyParser) calcRests() {
+	p.rests = make(map[string]Yield)
+	if p.level == 0 {
+		p.rests[p.root] = Yield{Min: 0, Max: 0}
+	}
+
+	// Predictions in the same column can be recursive, so iterate to a fixed
+	// point, as in Grammar.Yields.
+	for pass, changed := 0, true; changed; pass++ {
+		changed = false
+		for sym, states := range p.waiting {
+			if sym.Type != SVar {
+				continue
+			}
+			for _, s := range states {
+				rest, ok := p.restAfter(s)
+				if !ok {
+					continue
+				}
+				old, seen := p.rests[sym.Value]
+				if seen {
+					rest = old.Or(rest)
+					if pass > len(p.waiting) && rest.Max > old.Max {
+						rest.Max = Unbounded
+					}
+				}
+				if !seen || rest != old {
+					p.rests[sym.Value] = rest
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// restAfter finds the range of the number of phonemes that must follow the
+// symbol after the dot in s to finish the word.
+func (p *EarleyParser) restAfter(s *state) (Yield, bool) {
+	y, ok := p.synmodel.Yield(s.rhs[s.dot+1:], p.yields)
+	if !ok {
+		return Yield{}, false
+	}
+	up, ok := p.getLevel(s.start).rests[s.lhs]
+	if !ok {
+		return Yield{}, false
+	}
+	return y.Then(up), true
+}
+
+func (p *EarleyParser) calcSlots() {
+	slots := make(map[slotKey]*slot)
+	for sym, states := range p.waiting {
+		if sym.Type != CVar {
 			continue
 		}
 
-		term := s.rhs[s.dot]
-		if term.Type != CVar {
+		sset, ok := p.env.Lookup(sym.Value)
+		if !ok {
 			continue
 		}
 
-		if sset, ok := p.env.Lookup(term.Value); ok {
-			for k, v := range sset.Weights {
-				if _, ok := cset[k]; ok {
-					cset[k] += v * s.weight
+		for _, s := range states {
+			rest, ok := p.restAfter(s)
+			if !ok {
+				continue // can never finish a word
+			}
+			length := Yield{Min: int(p.level) + 1, Max: int(p.level) + 1}.Then(rest)
+			for scope, share := range p.active(s, p.scopes["#"+sym.Value]) {
+				k := slotKey{sym.Value, length, scope}
+				if sl, ok := slots[k]; ok {
+					sl.weight += s.weight * share
 				} else {
-					cset[k] = v * s.weight
+					slots[k] = &slot{class: sset, length: length, scope: scope, weight: s.weight * share}
 				}
 			}
 		}
 	}
-	return &cset
+
+	// fits is the range of lengths that every slot can reach
+	p.allowed = NewCharSet(p.env.Phonemes.Len())
+	p.fits = Yield{Min: 0, Max: Unbounded}
+	p.slots = make([]*slot, 0, len(slots))
+	for _, sl := range slots {
+		sl.addTo(p.allowed)
+		p.slots = append(p.slots, sl)
+		if sl.length.Min > p.fits.Min {
+			p.fits.Min = sl.length.Min
+		}
+		if sl.length.Max < p.fits.Max {
+			p.fits.Max = sl.length.Max
+		}
+	}
 }
@@ -0,0 +1,466 @@
+package earley
+
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+import . "github.com/conlang-software-dev/Logopoeist/grammar"
+import . "github.com/conlang-software-dev/Logopoeist/environment"
+
+// build makes an environment and grammar from class definitions, given as
+// "{name} {phoneme} ...", and syntax rules, given as "{name} -> {symbol} ...",
+// where each symbol is a "$" syntax variable or a "#" class variable. A rule
+// may end with a weight, as "*{weight}"; otherwise its weight is 1.
+func build(classes []string, rules []string) (*Environment, Grammar) {
+	env := NewEnvironment()
+	for _, def := range classes {
+		fields := strings.Fields(def)
+		var list *Node
+		for i := len(fields) - 1; i > 0; i-- {
+			list = &Node{
+				Type:  Seq,
+				Right: list,
+				Left: &Node{
+					Type:  Freq,
+					Left:  &Node{Type: Phoneme, Value: fields[i]},
+					Right: &Node{Type: Num, Value: "1"},
+				},
+			}
+		}
+		env.Assign(fields[0], &Node{Type: Class, Left: list})
+	}
+
+	g := make(Grammar)
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		rhs := []*Node{}
+		weight := 1.0
+		for _, f := range fields[2:] {
+			if f[0] == '*' {
+				weight, _ = strconv.ParseFloat(f[1:], 64)
+				continue
+			}
+			t := SVar
+			if f[0] == '#' {
+				t = CVar
+			}
+			rhs = append(rhs, &Node{Type: t, Value: f[1:]})
+		}
+		g.AddRule(fields[0], rhs, weight)
+	}
+	return env, g
+}
+
+// parse feeds a word, as a list of phonemes, to a new parser, and returns
+// the last level, or nil if the word is not a prefix of any valid word.
+func parse(env *Environment, g Grammar, root string, word string) *EarleyParser {
+	p := NewParser(env, g, root, nil)
+	for _, ph := range strings.Fields(word) {
+		var ok bool
+		if p, ok = p.Next(env.Phonemes.Intern(ph)); !ok {
+			return nil
+		}
+	}
+	return p
+}
+
+// checkWords checks which words are complete, valid words of the grammar.
+func checkWords(t *testing.T, env *Environment, g Grammar, root string, words map[string]bool) {
+	for word, valid := range words {
+		p := parse(env, g, root, word)
+		if got := p != nil && p.IsFinished(); got != valid {
+			t.Errorf("word %q: finished = %v, want %v", word, got, valid)
+		}
+	}
+}
+
+// checkWeights checks that every weight of the phonemes that could follow
+// the word is finite and positive.
+func checkWeights(t *testing.T, p *EarleyParser, word string) {
+	allowed := p.AllowedTokens(0, 0)
+	if allowed.Len() == 0 {
+		t.Errorf("after %q: no phonemes allowed", word)
+	}
+	for k, ok := allowed.Members.Next(0); ok; k, ok = allowed.Members.Next(k + 1) {
+		if w := allowed.Weights[k]; math.IsInf(w, 0) || math.IsNaN(w) || w <= 0 {
+			t.Errorf("after %q: weight of phoneme %d is %v", word, k, w)
+		}
+	}
+}
+
+func TestNullableChain(t *testing.T) {
+	env, g := build([]string{
+		"C p t",
+		"V a",
+		"N n",
+	}, []string{
+		"W -> $S $Coda",
+		"S -> #C #V",
+		"Coda -> $Coda2",
+		"Coda2 -> $Coda3",
+		"Coda3 ->",
+		"Coda3 -> #N",
+	})
+
+	nulls := g.Nullable()
+	for _, v := range []string{"Coda", "Coda2", "Coda3"} {
+		if math.Abs(nulls[v]-0.5) > 1e-9 {
+			t.Errorf("Nullable()[%s] = %v, want 0.5", v, nulls[v])
+		}
+	}
+	if _, ok := nulls["W"]; ok {
+		t.Errorf("W is nullable")
+	}
+
+	checkWords(t, env, g, "W", map[string]bool{
+		"":        false,
+		"p":       false,
+		"p a":     true,
+		"t a n":   true,
+		"p a n n": false,
+		"p a p":   false,
+	})
+	checkWeights(t, parse(env, g, "W", "p a"), "p a")
+}
+
+// Only the relative weights of a variable's rules matter, so scaling them all
+// by the same factor changes nothing.
+func TestNullableScale(t *testing.T) {
+	want := 0.0
+	for _, scale := range []float64{1, 2, 10} {
+		env, g := build([]string{
+			"C p",
+			"V a",
+			"N n",
+		}, []string{
+			"W -> $S $Coda",
+			"S -> #C #V",
+			fmt.Sprintf("Coda -> #N *%g", 3*scale),
+			fmt.Sprintf("Coda -> *%g", scale),
+		})
+
+		got := parse(env, g, "W", "p a").TerminationProbability()
+		if scale == 1 {
+			want = got
+		} else if math.Abs(got-want) > 1e-9 {
+			t.Errorf("scale %g: odds of ending after %q = %v, want %v", scale, "p a", got, want)
+		}
+	}
+}
+
+func TestNullableLeftRecursion(t *testing.T) {
+	env, g := build([]string{
+		"C p t",
+		"V a",
+	}, []string{
+		"W -> $W $S",
+		"W ->",
+		"S -> #C #V",
+	})
+
+	checkWords(t, env, g, "W", map[string]bool{
+		"":        true,
+		"p":       false,
+		"p a":     true,
+		"p a t a": true,
+		"p a a":   false,
+	})
+	for _, word := range []string{"", "p a", "p a t a"} {
+		checkWeights(t, parse(env, g, "W", word), word)
+	}
+
+	// a nullable symbol at the start of a left-recursive rule
+	env, g = build([]string{
+		"C p",
+		"V a",
+	}, []string{
+		"W -> $L #V",
+		"L -> $L #C",
+		"L ->",
+	})
+	checkWords(t, env, g, "W", map[string]bool{
+		"a":       true,
+		"p a":     true,
+		"p p p a": true,
+		"p":       false,
+		"a a":     false,
+	})
+}
+
+func TestDivergentNullable(t *testing.T) {
+	env, g := build([]string{
+		"C p",
+		"V a",
+	}, []string{
+		"W -> $A #V",
+		"A -> $A $A",
+		"A -> #C",
+		"A ->",
+	})
+
+	// A is empty with probability p = 1/3 + p²/3
+	want := (3 - math.Sqrt(5)) / 2
+	if got := g.Nullable()["A"]; math.Abs(got-want) > 1e-9 {
+		t.Errorf("Nullable()[A] = %v, want %v", got, want)
+	}
+
+	checkWords(t, env, g, "W", map[string]bool{
+		"a":       true,
+		"p a":     true,
+		"p p p a": true,
+		"a p":     false,
+	})
+	for _, word := range []string{"", "p", "p p"} {
+		checkWeights(t, parse(env, g, "W", word), word)
+	}
+	if p := parse(env, g, "W", "a"); p.TerminationProbability() <= 0 {
+		t.Errorf("cannot end after %q", "a")
+	}
+}
+
+func TestNonConvergentNullable(t *testing.T) {
+	_, g := build(nil, []string{
+		"A -> $A $A",
+		"A ->",
+	})
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Nullable() did not report the non-convergent grammar")
+		}
+	}()
+	g.Nullable()
+}
+
+// A parser with a maximum length drops the states of branches that cannot
+// finish in time, so they never offer phonemes or accept them.
+func TestWithin(t *testing.T) {
+	env, g := build([]string{
+		"C p t",
+		"V a",
+	}, []string{
+		"W -> $Short",
+		"W -> $Long",
+		"Short -> #C #V",
+		"Long -> #C #C #C #C",
+	})
+	p := env.Phonemes.Intern("p")
+
+	root := NewParser(env, g, "W", nil)
+	bounded := root.Within(3)
+	for _, s := range bounded.column {
+		if s.lhs == "Long" {
+			t.Errorf("a state of $Long is in the bounded chart")
+		}
+	}
+
+	np, _ := bounded.Next(p)
+	if np.AllowedTokens(0, 0).Has(p) {
+		t.Errorf("<p> is allowed after <p> without a length bound")
+	}
+	if _, ok := np.Next(p); ok {
+		t.Errorf("<p><p> accepted in words of at most 3 phonemes")
+	}
+	if np, _ := root.Next(p); !np.AllowedTokens(0, 0).Has(p) {
+		t.Errorf("<p> is not allowed after <p> in the unbounded parser")
+	}
+	checkWords(t, env, g, "W", map[string]bool{
+		"p a":     true,
+		"p p t p": true,
+	})
+}
+
+// Yields are found through recursion, and variables that can never finish a
+// word have none.
+func TestYields(t *testing.T) {
+	_, g := build(nil, []string{
+		"S -> #C #V",
+		"S -> #C #V #C",
+		"W -> $W $S",
+		"W -> $S",
+		"N -> #C",
+		"N ->",
+		"X -> $X #C",
+	})
+	want := map[string]Yield{
+		"S": {Min: 2, Max: 3},
+		"W": {Min: 2, Max: Unbounded},
+		"N": {Min: 0, Max: 1},
+	}
+
+	yields := g.Yields()
+	if len(yields) != len(want) {
+		t.Errorf("Yields() = %v, want %v", yields, want)
+	}
+	for v, y := range want {
+		if got, ok := yields[v]; !ok || got != y {
+			t.Errorf("Yields()[%s] = %v, want %v", v, got, y)
+		}
+	}
+}
+
+// Tempering changes how rule probabilities differ without changing the total
+// weight of any variable's rules, and leaves the original grammar alone.
+func TestTemperedGrammar(t *testing.T) {
+	_, g := build(nil, []string{
+		"S -> #C #V",
+		"S -> #V *3",
+	})
+	tests := []struct {
+		temp float64
+		want float64 // the probability of `$S -> #V`
+	}{
+		{1, 0.75},
+		{0.5, 0.9},
+		{2, math.Sqrt(3) / (1 + math.Sqrt(3))},
+	}
+	for _, test := range tests {
+		rset, _ := g.Tempered(test.temp).Rules("S")
+		if got := rset.Prob(1); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("temperature %g: probability %v, want %v", test.temp, got, test.want)
+		}
+		if sum := rset.Weights[0] + rset.Weights[1]; math.Abs(sum-4) > 1e-9 {
+			t.Errorf("temperature %g: total weight %v, want 4", test.temp, sum)
+		}
+	}
+	if rset, _ := g.Rules("S"); rset.Prob(1) != 0.75 {
+		t.Errorf("tempering changed the original grammar")
+	}
+}
+
+// The odds of ending weigh complete words only against the states that could
+// take another phoneme, not against the states that predicted them as well.
+func TestTerminationOdds(t *testing.T) {
+	tests := []struct {
+		rules []string
+		word  string
+		want  float64
+	}{
+		{[]string{"W -> $S", "W -> $S #N *3", "S -> #C #V"}, "p a", 1.0 / 3},
+		{[]string{"W -> $W $S", "W -> $S", "S -> #C #V"}, "p a", 1},
+		{[]string{"W -> $W $S", "W -> $S", "S -> #C #V"}, "p a p a", 1},
+		{[]string{"W -> $S", "W -> $S #N *3", "S -> #C #V"}, "p a n", math.Inf(1)},
+	}
+	for _, test := range tests {
+		env, g := build([]string{"C p", "V a", "N n"}, test.rules)
+		got := parse(env, g, "W", test.word).TerminationProbability()
+		if math.Abs(got-test.want) > 1e-9 && got != test.want {
+			t.Errorf("%v: odds of ending after %q = %v, want %v", test.rules, test.word, got, test.want)
+		}
+	}
+}
+
+// syllableGrammar builds a grammar for words of any number of syllables,
+// each made from one of n onsets, a vowel, and one of n codas, for n*n
+// syllable templates in all.
+func syllableGrammar(n int) (*Environment, Grammar) {
+	classes := []string{"V a e i o u"}
+	rules := []string{
+		"W -> $W $S",
+		"W -> $S",
+	}
+	consonants := strings.Fields("p t k b d g m n s z f v l r")
+	for i := 0; i < n; i++ {
+		// each onset and coda is a different pair of consonants
+		c1 := consonants[i%len(consonants)]
+		c2 := consonants[(i*5+3)%len(consonants)]
+		classes = append(classes, fmt.Sprintf("O%d %s %s", i, c1, c2))
+		classes = append(classes, fmt.Sprintf("K%d %s %s", i, c2, c1))
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			rules = append(rules, fmt.Sprintf("S -> #O%d #V #K%d", i, j))
+		}
+	}
+	return build(classes, rules)
+}
+
+const benchWord = "p a s t o k m i f d u p"
+
+func BenchmarkNext(b *testing.B) {
+	env, g := syllableGrammar(8)
+	var word []ID
+	for _, ph := range strings.Fields(benchWord) {
+		word = append(word, env.Phonemes.Intern(ph))
+	}
+	root := NewParser(env, g, "W", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := root
+		for _, k := range word {
+			var ok bool
+			if p, ok = p.Next(k); !ok {
+				b.Fatalf("word rejected at %s", env.Phonemes.Name(k))
+			}
+		}
+	}
+}
+
+// BenchmarkChartLookup compares the chart's indexes against the linear scans
+// they replace, on the columns of a word parsed with a large grammar: finding
+// an existing copy of each state, and finding the states waiting on the
+// symbol that each complete state derives.
+func BenchmarkChartLookup(b *testing.B) {
+	env, g := syllableGrammar(8)
+	var columns []*EarleyParser
+	p := NewParser(env, g, "W", nil)
+	for _, ph := range strings.Fields(benchWord) {
+		columns = append(columns, p)
+		p, _ = p.Next(env.Phonemes.Intern(ph))
+	}
+	columns = append(columns, p)
+
+	b.Run("Indexed", func(b *testing.B) {
+		found := 0
+		for i := 0; i < b.N; i++ {
+			for _, p := range columns {
+				for _, s := range p.column {
+					if _, ok := p.index[s.key()]; ok {
+						found++
+					}
+					if s.iscomplete() && s.start < p.level {
+						found += len(p.getLevel(s.start).waiting[completes(s)])
+					}
+				}
+			}
+		}
+	})
+
+	b.Run("Linear", func(b *testing.B) {
+		found := 0
+		for i := 0; i < b.N; i++ {
+			for _, p := range columns {
+				for _, s := range p.column {
+					k := s.key()
+					for _, old := range p.column {
+						if old.key() == k {
+							found++
+							break
+						}
+					}
+					if !s.iscomplete() || s.start >= p.level {
+						continue
+					}
+					sym := completes(s)
+					for _, old := range p.getLevel(s.start).column {
+						if !old.iscomplete() && (symbol{old.rhs[old.dot].Type, old.rhs[old.dot].Value}) == sym {
+							found++
+						}
+					}
+				}
+			}
+		}
+	})
+}
+
+// completes gives the symbol that a complete state derives.
+func completes(s *state) symbol {
+	if s.terminal {
+		return symbol{CVar, s.lhs}
+	}
+	return symbol{SVar, s.lhs}
+}
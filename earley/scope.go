@@ -0,0 +1,118 @@
+package earley
+
+import "math"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// unscoped is the share of every state when no scopes are in use; it must
+// not be modified.
+var unscoped = map[uint64]float64{0: 1}
+
+// calcScopes finds, for every syntax variable predicted in this column, how
+// the weight of the states that predicted it is divided between the sets of
+// scopes that are active in them. Predictions in the same column can be
+// recursive, so the shares are found by iterating to a fixed point, as in
+// Grammar.Nullable.
+func (p *EarleyParser) calcScopes() {
+	if len(p.scopes) == 0 {
+		return
+	}
+
+	p.actives = make(map[string]map[uint64]float64)
+	for i := 0; i < 100; i++ {
+		actives := make(map[string]map[uint64]float64)
+		if p.level == 0 {
+			actives[p.root] = map[uint64]float64{0: 1}
+		}
+		for sym, states := range p.waiting {
+			if sym.Type != SVar {
+				continue
+			}
+			shares, ok := actives[sym.Value]
+			if !ok {
+				shares = make(map[uint64]float64)
+				actives[sym.Value] = shares
+			}
+			for _, s := range states {
+				for scope, share := range p.active(s, 0) {
+					shares[scope] += s.weight * share
+				}
+			}
+		}
+
+		delta := 0.0
+		for v, shares := range actives {
+			total := 0.0
+			for _, w := range shares {
+				total += w
+			}
+			for scope := range shares {
+				if total > 0 {
+					shares[scope] /= total
+				}
+				delta = math.Max(delta, math.Abs(shares[scope]-p.actives[v][scope]))
+			}
+		}
+		p.actives = actives
+		if delta < 1e-12 {
+			break
+		}
+	}
+}
+
+// active finds how the weight of s is divided between the sets of scopes
+// that are active in it, including s's own symbol and any extra scopes.
+func (p *EarleyParser) active(s *state, extra uint64) map[uint64]float64 {
+	if len(p.scopes) == 0 {
+		return unscoped
+	}
+
+	own := p.scopes["$"+s.lhs] | extra
+	up := p.getLevel(s.start).actives[s.lhs]
+	if len(up) == 0 {
+		return map[uint64]float64{own: 1}
+	}
+	shares := make(map[uint64]float64, len(up))
+	for scope, share := range up {
+		shares[scope|own] += share
+	}
+	return shares
+}
+
+// ScopedTokens is like AllowedTokens, but splits the phonemes that could
+// come next by the set of scopes active in the slots that they would fill,
+// as a set of bits from the scopes given to NewParser.
+func (p *EarleyParser) ScopedTokens(min int, max int) map[uint64]*CharSet {
+	csets := make(map[uint64]*CharSet)
+	for _, sl := range p.slots {
+		if sl.length.Max >= min && (max <= 0 || sl.length.Min <= max) {
+			cset, ok := csets[sl.scope]
+			if !ok {
+				cset = NewCharSet(p.env.Phonemes.Len())
+				csets[sl.scope] = cset
+			}
+			sl.addTo(cset)
+		}
+	}
+	return csets
+}
+
+// EndScopes finds how the weight of the parses that could finish the word at
+// this level is divided between the sets of scopes that were active for the
+// last token, in the same form as ScopedTokens. As in NextIn, only the scopes
+// for which allowed returns true are counted, unless allowed is nil.
+func (p *EarleyParser) EndScopes(token ID, allowed func(scope uint64) bool) map[uint64]float64 {
+	if p.parent == nil || len(p.scopes) == 0 {
+		return unscoped
+	}
+	shares := make(map[uint64]float64)
+	for _, sl := range p.parent.slots {
+		if sl.length.Min != int(p.level) || !sl.class.Contains(token) {
+			continue // the parse cannot finish right after the token
+		}
+		if allowed == nil || allowed(sl.scope) {
+			shares[sl.scope] += sl.weight * sl.class.Weights.Weight(token)
+		}
+	}
+	return shares
+}
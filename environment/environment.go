@@ -1,34 +1,76 @@
 package environment
 
 import "fmt"
+import "math"
+import "sort"
 import "strconv"
 import . "github.com/conlang-software-dev/Logopoeist/parser"
 import . "github.com/conlang-software-dev/Logopoeist/types"
 import . "github.com/conlang-software-dev/Logopoeist/interpreter"
+import . "github.com/conlang-software-dev/Logopoeist/features"
 
-type Environment map[string]*CharClass
+type Environment struct {
+	Phonemes *Inventory
+	classes  map[string]*CharClass
+	features map[ID]Bundle // declared features, which override the IPA table
+	params   map[string][]string
+}
+
+func NewEnvironment() *Environment {
+	return &Environment{
+		Phonemes: NewInventory(),
+		classes:  make(map[string]*CharClass),
+		features: make(map[ID]Bundle),
+		params:   make(map[string][]string),
+	}
+}
 
-func (e Environment) Assign(varname string, n *Node) {
-	e[varname] = e.GetClass(n)
+func (e *Environment) Assign(varname string, n *Node) {
+	e.classes[varname] = e.GetClass(n)
 }
 
 var nextvar = 0
 
-func (e Environment) AssignNew(n *Node) string {
+func (e *Environment) AssignNew(n *Node) string {
 	nextvar += 1
 	varname := strconv.Itoa(nextvar)
-	e[varname] = e.GetClass(n)
+	e.classes[varname] = e.GetClass(n)
 	return varname
 }
 
-func (e Environment) Lookup(varname string) (*CharClass, bool) {
-	if cclass, ok := e[varname]; ok {
+func (e *Environment) Lookup(varname string) (*CharClass, bool) {
+	if cclass, ok := e.classes[varname]; ok {
 		return cclass, true
 	}
 	return nil, false
 }
 
-func (e Environment) GetClass(n *Node) *CharClass {
+// Tempered returns a copy of the environment whose classes have their
+// phoneme weights raised to the power 1/temp, and rescaled to the same total,
+// as Grammar.Tempered does for rules. The copy shares the phoneme inventory.
+func (e *Environment) Tempered(temp float64) *Environment {
+	if temp == 1 {
+		return e
+	}
+	ne := *e
+	ne.classes = make(map[string]*CharClass, len(e.classes))
+	for v, cclass := range e.classes {
+		weights := cclass.Weights.Copy()
+		total := cclass.Weights.Total()
+		for k, ok := weights.Members.Next(0); ok; k, ok = weights.Members.Next(k + 1) {
+			weights.Weights[k] = math.Pow(weights.Weights[k], 1/temp)
+		}
+		if sum := weights.Total(); sum > 0 {
+			for k, ok := weights.Members.Next(0); ok; k, ok = weights.Members.Next(k + 1) {
+				weights.Weights[k] *= total / sum
+			}
+		}
+		ne.classes[v] = &CharClass{List: cclass.List, Weights: weights}
+	}
+	return &ne
+}
+
+func (e *Environment) GetClass(n *Node) *CharClass {
 	switch n.Type {
 	case CVar:
 		if cclass, ok := e.Lookup(n.Value); ok {
@@ -36,8 +78,146 @@ func (e Environment) GetClass(n *Node) *CharClass {
 		}
 		panic(fmt.Sprintf("Variable #%s referenced before definition", n.Value))
 	case Class:
-		return InterpretClass(n)
+		return InterpretClass(n, e.Phonemes)
+	case ClassOp:
+		return CombineClasses(n.Value, e.GetClass(n.Left), e.GetClass(n.Right), e.Phonemes)
+	case Matrix:
+		return e.matrixClass(n)
+	case Boundary:
+		weights := NewCharSet(1)
+		weights.Add(WordBoundary, 1)
+		return &CharClass{
+			List:    []ID{WordBoundary},
+			Weights: weights,
+		}
 	default:
 		panic(fmt.Sprintf("Invalid Node Type for Character Class: %s", n.ToString()))
 	}
 }
+
+// Declare gives every phoneme in a class the features in a matrix, in place
+// of any that it has in the IPA table.
+func (e *Environment) Declare(class *Node, matrix *Node) {
+	bundle := make(Bundle)
+	for sn := matrix.Left; sn != nil; sn = sn.Right {
+		f := sn.Left
+		if f.Left.Type == FeatureVar {
+			panic(fmt.Sprintf("Feature variable %s used in a Feature Declaration", f.ToString()))
+		}
+		bundle[f.Value] = f.Left.Value
+	}
+	for _, k := range e.GetClass(class).List {
+		e.features[k] = bundle
+	}
+}
+
+// Features returns the features of a phoneme: those declared for it, or
+// else those in the IPA table, if it is there.
+func (e *Environment) Features(k ID) Bundle {
+	if bundle, ok := e.features[k]; ok {
+		return bundle
+	}
+	return Default(e.Phonemes.Name(k))
+}
+
+// matrixClass finds the phonemes seen so far that have every feature in a
+// matrix, each with a frequency of 1.
+func (e *Environment) matrixClass(n *Node) *CharClass {
+	for sn := n.Left; sn != nil; sn = sn.Right {
+		if sn.Left.Left.Type == FeatureVar {
+			panic(fmt.Sprintf("Feature variable %s can only be used in Condition Expressions", sn.Left.ToString()))
+		}
+	}
+
+	list := make([]ID, 0, 10)
+	weights := NewCharSet(e.Phonemes.Len())
+	for k := ID(1); int(k) < e.Phonemes.Len(); k++ {
+		bundle := e.Features(k)
+		matches := true
+		for sn := n.Left; sn != nil && matches; sn = sn.Right {
+			matches = bundle.Matches(sn.Left.Value, sn.Left.Left.Value)
+		}
+		if matches {
+			list = append(list, k)
+			weights.Add(k, 1)
+		}
+	}
+	return &CharClass{
+		List:    list,
+		Weights: weights,
+	}
+}
+
+// Expand makes a copy of a rule for every combination of values of the
+// feature variables in it, such as the α in [αplace]. A variable ranges over
+// every value of the features that it is used with, among the phonemes seen
+// so far. A rule with no variables is returned as it is.
+func (e *Environment) Expand(n *Node) []*Node {
+	found := make(map[string]map[string]bool)
+	var vars []string
+	var collect func(n *Node)
+	collect = func(n *Node) {
+		if n == nil {
+			return
+		}
+		if n.Type == Feature && n.Left.Type == FeatureVar {
+			v := n.Left.Value
+			if _, ok := found[v]; !ok {
+				found[v] = make(map[string]bool)
+				vars = append(vars, v)
+			}
+			for k := ID(1); int(k) < e.Phonemes.Len(); k++ {
+				if value, ok := e.Features(k)[n.Value]; ok {
+					found[v][value] = true
+				}
+			}
+			return
+		}
+		collect(n.Left)
+		collect(n.Right)
+	}
+	collect(n)
+
+	values := make(map[string][]string, len(vars))
+	for _, v := range vars {
+		for value := range found[v] {
+			values[v] = append(values[v], value)
+		}
+		sort.Strings(values[v])
+	}
+	return substitute(n, FeatureVar, FeatureValue, vars, values)
+}
+
+// substitute makes a copy of a command for every combination of the values
+// of vars, in which every node of type typ that names one of the variables
+// is replaced by a node of type bound holding its value.
+func substitute(n *Node, typ int, bound int, vars []string, values map[string][]string) []*Node {
+	cmds := []*Node{n}
+	for _, v := range vars {
+		next := make([]*Node, 0, len(cmds)*len(values[v]))
+		for _, cmd := range cmds {
+			for _, value := range values[v] {
+				next = append(next, bind(cmd, typ, v, &Node{Type: bound, Value: value}))
+			}
+		}
+		cmds = next
+	}
+	return cmds
+}
+
+// bind copies a command, replacing every node of type typ that names the
+// variable v with value.
+func bind(n *Node, typ int, v string, value *Node) *Node {
+	if n == nil {
+		return nil
+	}
+	if n.Type == typ && n.Value == v {
+		return value
+	}
+	return &Node{
+		Type:  n.Type,
+		Value: n.Value,
+		Left:  bind(n.Left, typ, v, value),
+		Right: bind(n.Right, typ, v, value),
+	}
+}
@@ -0,0 +1,123 @@
+package environment
+
+import "sort"
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+
+// class makes a literal class from phonemes, each with a frequency of 1.
+func class(phonemes ...string) *Node {
+	var list *Node
+	for i := len(phonemes) - 1; i >= 0; i-- {
+		list = &Node{Type: Seq, Right: list, Left: &Node{
+			Type:  Freq,
+			Left:  &Node{Type: Phoneme, Value: phonemes[i]},
+			Right: &Node{Type: Num, Value: "1"},
+		}}
+	}
+	return &Node{Type: Class, Left: list}
+}
+
+// matrix makes a feature matrix from features written as in a
+// configuration file, such as "+nasal", "place=labial" or "αplace".
+func matrix(features ...string) *Node {
+	var list *Node
+	for i := len(features) - 1; i >= 0; i-- {
+		f := features[i]
+		n := &Node{Type: Feature}
+		switch {
+		case f[0] == '+' || f[0] == '-':
+			n.Value, n.Left = f[1:], &Node{Type: FeatureValue, Value: f[:1]}
+		case strings.HasPrefix(f, "α"):
+			n.Value, n.Left = f[len("α"):], &Node{Type: FeatureVar, Value: "α"}
+		default:
+			parts := strings.SplitN(f, "=", 2)
+			n.Value, n.Left = parts[0], &Node{Type: FeatureValue, Value: parts[1]}
+		}
+		list = &Node{Type: Seq, Left: n, Right: list}
+	}
+	return &Node{Type: Matrix, Left: list}
+}
+
+// members lists the phonemes of a class, sorted.
+func members(e *Environment, n *Node) string {
+	var names []string
+	for _, k := range e.GetClass(n).List {
+		names = append(names, e.Phonemes.Name(k))
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestMatrixClasses(t *testing.T) {
+	e := NewEnvironment()
+	e.Assign("All", class("p", "t", "m", "n", "a", "i"))
+
+	tests := []struct {
+		matrix *Node
+		want   string
+	}{
+		{matrix("+nasal"), "m n"},
+		{matrix("+syllabic", "-high"), "a"},
+		{matrix("-nasal", "-syllabic"), "p t"},
+		{matrix("place=labial"), "m p"},
+		{matrix("+nasal", "place=labial"), "m"},
+	}
+	for _, test := range tests {
+		if got := members(e, test.matrix); got != test.want {
+			t.Errorf("%s = <%s>, want <%s>", test.matrix.ToString(), got, test.want)
+		}
+	}
+
+	// declared features replace those in the table
+	e.Declare(class("m"), matrix("-nasal", "+weird"))
+	if got := members(e, matrix("+nasal")); got != "n" {
+		t.Errorf("[+nasal] = <%s> after declaring <m> [-nasal], want <n>", got)
+	}
+	if got := members(e, matrix("+weird")); got != "m" {
+		t.Errorf("[+weird] = <%s>, want <m>", got)
+	}
+}
+
+// A matrix is resolved against the phonemes seen when it is read, including
+// any made by concatenation along the way.
+func TestMatrixOrder(t *testing.T) {
+	e := NewEnvironment()
+	e.Assign("Stop", class("p", "t"))
+	e.Assign("Spread", matrix("+spread"))
+	e.Assign("Asp", &Node{Type: ClassOp, Value: "++", Left: &Node{Type: CVar, Value: "Stop"}, Right: class("ʰ")})
+
+	if got := members(e, &Node{Type: CVar, Value: "Spread"}); got != "" {
+		t.Errorf("#Spread = <%s>, want <>, from before #Asp", got)
+	}
+	if got := members(e, matrix("+spread")); got != "pʰ tʰ" {
+		t.Errorf("[+spread] = <%s> after #Asp, want <pʰ tʰ>", got)
+	}
+}
+
+func TestExpandFeatures(t *testing.T) {
+	e := NewEnvironment()
+	e.Assign("All", class("p", "k", "m", "ŋ", "a"))
+	// [+nasal] -> [αplace]
+	rule := &Node{
+		Type:  Condition,
+		Left:  &Node{Type: Seq, Left: matrix("+nasal")},
+		Right: matrix("αplace"),
+	}
+
+	var got []string
+	for _, n := range e.Expand(rule) {
+		got = append(got, strings.TrimSpace(n.ToString()))
+	}
+	want := []string{"[+nasal] -> [place=labial]", "[+nasal] -> [place=velar]"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("expanded to %q, want %q", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("a feature variable in a class definition was accepted")
+		}
+	}()
+	e.Assign("X", matrix("αplace"))
+}
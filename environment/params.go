@@ -0,0 +1,87 @@
+package environment
+
+import "fmt"
+import "strings"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+
+// DeclareParam declares a parameter for syntax and class variables, and
+// the values that it ranges over.
+func (e *Environment) DeclareParam(n *Node) {
+	var values []string
+	for sn := n.Left; sn != nil; sn = sn.Right {
+		values = append(values, sn.Left.Value)
+	}
+	e.params[n.Value] = values
+}
+
+// ExpandParams makes a copy of a command for every combination of values of
+// the parameters used in the indices of its variables, as in "$W[h]", so
+// that every use of a parameter in the command has the same value. In the
+// copies, each indexed variable is renamed to include its index, as in
+// "W[front]", so that it is an ordinary variable from then on.
+func (e *Environment) ExpandParams(cmd *Node) []*Node {
+	seen := make(map[string]bool)
+	var vars []string
+	var collect func(n *Node)
+	collect = func(n *Node) {
+		if n == nil {
+			return
+		}
+		if n.Type == Index {
+			if _, ok := e.params[n.Value]; ok {
+				if !seen[n.Value] {
+					seen[n.Value] = true
+					vars = append(vars, n.Value)
+				}
+			} else if !e.isValue(n.Value) {
+				panic(fmt.Sprintf("Unknown parameter or value %s in %s", n.Value, strings.TrimSpace(cmd.ToString())))
+			}
+			return
+		}
+		collect(n.Left)
+		collect(n.Right)
+	}
+	collect(cmd)
+
+	cmds := substitute(cmd, Index, Index, vars, e.params)
+	for i, cmd := range cmds {
+		cmds[i] = rename(cmd)
+	}
+	return cmds
+}
+
+// isValue checks whether s is a value of any parameter.
+func (e *Environment) isValue(s string) bool {
+	for _, values := range e.params {
+		for _, value := range values {
+			if value == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rename copies a command, giving every indexed variable a name that
+// includes its index.
+func rename(n *Node) *Node {
+	if n == nil {
+		return nil
+	}
+	if (n.Type == SVar || n.Type == CVar) && n.Left != nil {
+		var index []string
+		for sn := n.Left; sn != nil; sn = sn.Right {
+			index = append(index, sn.Left.Value)
+		}
+		return &Node{
+			Type:  n.Type,
+			Value: fmt.Sprintf("%s[%s]", n.Value, strings.Join(index, " ")),
+		}
+	}
+	return &Node{
+		Type:  n.Type,
+		Value: n.Value,
+		Left:  rename(n.Left),
+		Right: rename(n.Right),
+	}
+}
@@ -0,0 +1,203 @@
+package features
+
+import "strings"
+
+// Bundle maps the names of a phoneme's distinctive features to their values.
+// Binary features have the values "+" and "-"; others, like place, can have
+// any value.
+type Bundle map[string]string
+
+// Matches checks whether the phoneme has the given value for a feature.
+// A phoneme never matches a feature that it does not specify.
+func (b Bundle) Matches(feature string, value string) bool {
+	v, ok := b[feature]
+	return ok && v == value
+}
+
+func (b Bundle) copy() Bundle {
+	c := make(Bundle, len(b))
+	for f, v := range b {
+		c[f] = v
+	}
+	return c
+}
+
+// parse reads a list of feature specifications in the form used by the
+// tables below: "+feature", "-feature", or "feature=value".
+func parse(spec string) Bundle {
+	b := make(Bundle)
+	for _, f := range strings.Fields(spec) {
+		switch {
+		case strings.HasPrefix(f, "+"), strings.HasPrefix(f, "-"):
+			b[f[1:]] = f[:1]
+		default:
+			i := strings.Index(f, "=")
+			b[f[:i]] = f[i+1:]
+		}
+	}
+	return b
+}
+
+// The features of each manner of articulation for consonants, and of each
+// height and backness for vowels.
+var manners = map[string]string{
+	"stop":      "-syllabic +consonantal -sonorant -continuant -delayed -nasal -lateral",
+	"affricate": "-syllabic +consonantal -sonorant -continuant +delayed -nasal -lateral",
+	"fricative": "-syllabic +consonantal -sonorant +continuant -delayed -nasal -lateral",
+	"latfric":   "-syllabic +consonantal -sonorant +continuant -delayed -nasal +lateral",
+	"nasal":     "-syllabic +consonantal +sonorant -continuant -delayed +nasal -lateral",
+	"trill":     "-syllabic +consonantal +sonorant +continuant -delayed -nasal -lateral",
+	"approx":    "-syllabic +consonantal +sonorant +continuant -delayed -nasal -lateral",
+	"lateral":   "-syllabic +consonantal +sonorant +continuant -delayed -nasal +lateral",
+	"glide":     "-syllabic -consonantal +sonorant +continuant -delayed -nasal -lateral",
+	"glottal":   "-syllabic -consonantal -sonorant -delayed -nasal -lateral",
+}
+
+var heights = map[string]string{
+	"close":      "+high -low +tense",
+	"near-close": "+high -low -tense",
+	"close-mid":  "-high -low +tense",
+	"mid":        "-high -low -tense",
+	"open-mid":   "-high -low -tense",
+	"open":       "-high +low -tense",
+}
+
+var backnesses = map[string]string{
+	"front":   "+front -back",
+	"central": "-front -back",
+	"back":    "-front +back",
+}
+
+// The IPA consonants, as a place, a manner, and the voiceless and voiced
+// symbols, either of which may be "".
+var consonants = [][4]string{
+	{"labial", "stop", "p", "b"},
+	{"labial", "nasal", "", "m"},
+	{"labial", "trill", "", "ʙ"},
+	{"labial", "fricative", "ɸ", "β"},
+	{"labiodental", "fricative", "f", "v"},
+	{"labiodental", "nasal", "", "ɱ"},
+	{"labiodental", "approx", "", "ʋ"},
+	{"dental", "fricative", "θ", "ð"},
+	{"alveolar", "stop", "t", "d"},
+	{"alveolar", "affricate", "ts", "dz"},
+	{"alveolar", "nasal", "", "n"},
+	{"alveolar", "trill", "", "r"},
+	{"alveolar", "trill", "", "ɾ"},
+	{"alveolar", "fricative", "s", "z"},
+	{"alveolar", "latfric", "ɬ", "ɮ"},
+	{"alveolar", "approx", "", "ɹ"},
+	{"alveolar", "lateral", "", "l"},
+	{"postalveolar", "affricate", "tʃ", "dʒ"},
+	{"postalveolar", "fricative", "ʃ", "ʒ"},
+	{"retroflex", "stop", "ʈ", "ɖ"},
+	{"retroflex", "nasal", "", "ɳ"},
+	{"retroflex", "trill", "", "ɽ"},
+	{"retroflex", "fricative", "ʂ", "ʐ"},
+	{"retroflex", "approx", "", "ɻ"},
+	{"retroflex", "lateral", "", "ɭ"},
+	{"palatal", "stop", "c", "ɟ"},
+	{"palatal", "nasal", "", "ɲ"},
+	{"palatal", "fricative", "ç", "ʝ"},
+	{"palatal", "glide", "", "j"},
+	{"palatal", "lateral", "", "ʎ"},
+	{"velar", "stop", "k", "ɡ"},
+	{"velar", "stop", "", "g"},
+	{"velar", "nasal", "", "ŋ"},
+	{"velar", "fricative", "x", "ɣ"},
+	{"velar", "glide", "", "ɰ"},
+	{"velar", "glide", "", "w"},
+	{"velar", "lateral", "", "ʟ"},
+	{"uvular", "stop", "q", "ɢ"},
+	{"uvular", "nasal", "", "ɴ"},
+	{"uvular", "trill", "", "ʀ"},
+	{"uvular", "fricative", "χ", "ʁ"},
+	{"pharyngeal", "fricative", "ħ", "ʕ"},
+	{"glottal", "glottal", "ʔ", ""},
+	{"glottal", "glottal", "h", "ɦ"},
+}
+
+// The IPA vowels, as a height, a backness, and the unrounded and rounded
+// symbols, either of which may be "".
+var vowels = [][4]string{
+	{"close", "front", "i", "y"},
+	{"close", "central", "ɨ", "ʉ"},
+	{"close", "back", "ɯ", "u"},
+	{"near-close", "front", "ɪ", "ʏ"},
+	{"near-close", "back", "", "ʊ"},
+	{"close-mid", "front", "e", "ø"},
+	{"close-mid", "central", "ɘ", "ɵ"},
+	{"close-mid", "back", "ɤ", "o"},
+	{"mid", "central", "ə", ""},
+	{"open-mid", "front", "ɛ", "œ"},
+	{"open-mid", "central", "ɜ", "ɞ"},
+	{"open-mid", "back", "ʌ", "ɔ"},
+	{"open", "front", "æ", ""},
+	{"open", "front", "a", "ɶ"},
+	{"open", "central", "ɐ", ""},
+	{"open", "back", "ɑ", "ɒ"},
+}
+
+// Diacritics that can follow a phoneme in the table, and the features that
+// they change.
+var diacritics = map[string]string{
+	"ː":      "+long",
+	"ʰ":      "+spread",
+	"ʷ":      "+round",
+	"\u0303": "+nasal",    // combining tilde
+	"\u0325": "-voice",    // combining ring below
+	"\u0329": "+syllabic", // combining vertical line below
+}
+
+var table = make(map[string]Bundle)
+
+func init() {
+	for _, c := range consonants {
+		for i, voice := range []string{"-voice", "+voice"} {
+			if c[2+i] == "" {
+				continue
+			}
+			b := parse(manners[c[1]] + " " + voice + " -round -long -spread")
+			b["place"] = c[0]
+			table[c[2+i]] = b
+		}
+	}
+	table["w"]["round"] = "+"
+	table["h"]["continuant"] = "+"
+	table["ɦ"]["continuant"] = "+"
+	table["ʔ"]["continuant"] = "-"
+
+	for _, v := range vowels {
+		for i, round := range []string{"-round", "+round"} {
+			if v[2+i] == "" {
+				continue
+			}
+			spec := "+syllabic -consonantal +sonorant +continuant -nasal -lateral +voice -long -spread "
+			table[v[2+i]] = parse(spec + heights[v[0]] + " " + backnesses[v[1]] + " " + round)
+		}
+	}
+}
+
+// Default looks up the features of a phoneme in the built-in IPA table,
+// allowing for any number of the diacritics above after the base symbol. It
+// returns nil if the phoneme is not in the table.
+func Default(phoneme string) Bundle {
+	if b, ok := table[phoneme]; ok {
+		return b
+	}
+	for d, spec := range diacritics {
+		if !strings.HasSuffix(phoneme, d) {
+			continue
+		}
+		base := Default(strings.TrimSuffix(phoneme, d))
+		if base == nil {
+			continue
+		}
+		b := base.copy()
+		for f, v := range parse(spec) {
+			b[f] = v
+		}
+		return b
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package features
+
+import "testing"
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		phoneme string
+		want    string // features that must match
+	}{
+		{"m", "+nasal +voice place=labial"},
+		{"p", "-nasal -voice -spread place=labial"},
+		{"a", "+syllabic -high -round"},
+		{"pʰ", "-voice +spread place=labial"},
+		{"aː", "+syllabic +long"},
+		{"kʰʷ", "-voice +spread +round place=velar"},
+		{"n̥", "+nasal -voice"},
+	}
+	for _, test := range tests {
+		b := Default(test.phoneme)
+		if b == nil {
+			t.Errorf("%s is not in the table", test.phoneme)
+			continue
+		}
+		for f, v := range parse(test.want) {
+			if !b.Matches(f, v) {
+				t.Errorf("%s: %s = %q, want %q", test.phoneme, f, b[f], v)
+			}
+		}
+	}
+
+	for _, phoneme := range []string{"", "ʰ", "xyz", "pq"} {
+		if b := Default(phoneme); b != nil {
+			t.Errorf("%q has features %v, want none", phoneme, b)
+		}
+	}
+
+	// diacritics never change the table itself
+	Default("mː")
+	if Default("m").Matches("long", "+") {
+		t.Errorf("looking up <mː> changed <m>")
+	}
+}
@@ -1,5 +1,7 @@
 package grammar
 
+import "fmt"
+import "math"
 import . "github.com/conlang-software-dev/Logopoeist/parser"
 
 type RuleSet struct {
@@ -24,9 +26,236 @@ func (g Grammar) AddRule(v string, rule []*Node, weight float64) {
 	}
 }
 
+// Prob gives the probability of choosing rule i, i.e. its weight relative
+// to the total weight of the rule set.
+func (rset *RuleSet) Prob(i int) float64 {
+	return rset.Weights[i] / rset.total
+}
+
 func (g Grammar) Rules(v string) (*RuleSet, bool) {
 	if ruleset, ok := g[v]; ok {
 		return ruleset, true
 	}
 	return &RuleSet{}, false
 }
+
+// Nullable finds every syntax variable that can derive the empty string,
+// and maps it to the probability that it does, with the weights of each
+// variable's rules taken relative to their total. It panics if the
+// probabilities cannot be found.
+func (g Grammar) Nullable() map[string]float64 {
+	nullable := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for v, rset := range g {
+			if nullable[v] {
+				continue
+			}
+			for _, rhs := range rset.Rules {
+				if g.allNullable(rhs, nullable) {
+					nullable[v] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// Empty derivations can be recursive (e.g., `$A -> $A $A`), so the
+	// probabilities are found by iterating to a fixed point. Starting from 0,
+	// they only grow, and never past 1, but they can approach it too slowly
+	// to be found, as with `$A -> $A $A` and `$A ->` alone.
+	nulls := make(map[string]float64, len(nullable))
+	for i := 0; ; i++ {
+		delta := 0.0
+		slowest := ""
+		for v := range nullable {
+			rset := g[v]
+			prob := 0.0
+			for j, rhs := range rset.Rules {
+				p := rset.Prob(j)
+				for _, n := range rhs {
+					p *= nulls[n.Value]
+					if n.Type != SVar {
+						p = 0
+					}
+				}
+				prob += p
+			}
+			if d := math.Abs(prob - nulls[v]); d >= delta {
+				delta = d
+				slowest = v
+			}
+			nulls[v] = prob
+		}
+		if delta < 1e-12 && i >= len(nullable) {
+			break
+		}
+		if i >= maxNullIterations {
+			panic(fmt.Sprintf("The probability that $%s is empty does not converge", slowest))
+		}
+	}
+	return nulls
+}
+
+// the number of iterations after which Nullable gives up
+const maxNullIterations = 10000
+
+func (g Grammar) allNullable(rhs []*Node, nullable map[string]bool) bool {
+	for _, n := range rhs {
+		if n.Type != SVar || !nullable[n.Value] {
+			return false
+		}
+	}
+	return true
+}
+
+// Unbounded is the maximum length of a Yield that has no upper bound.
+const Unbounded = math.MaxInt32
+
+// Yield is the range of the numbers of phonemes that can be derived from a
+// sequence of symbols.
+type Yield struct {
+	Min int
+	Max int
+}
+
+// Then returns the yield of y followed by o.
+func (y Yield) Then(o Yield) Yield {
+	return Yield{
+		Min: saturate(y.Min + o.Min),
+		Max: saturate(y.Max + o.Max),
+	}
+}
+
+// Or returns the yield of a choice between y and o.
+func (y Yield) Or(o Yield) Yield {
+	if o.Min < y.Min {
+		y.Min = o.Min
+	}
+	if o.Max > y.Max {
+		y.Max = o.Max
+	}
+	return y
+}
+
+func saturate(n int) int {
+	if n > Unbounded {
+		return Unbounded
+	}
+	return n
+}
+
+// Yields finds the minimum and maximum number of phonemes that can be
+// derived from each syntax variable. Variables that cannot derive any finite
+// string at all are left out.
+func (g Grammar) Yields() map[string]Yield {
+	mins := make(map[string]int)
+	for changed := true; changed; {
+		changed = false
+		for v, rset := range g {
+			for _, rhs := range rset.Rules {
+				if n, ok := g.minYield(rhs, mins); ok {
+					if old, ok := mins[v]; !ok || n < old {
+						mins[v] = n
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	// Recursive symbols can make the maximum grow without bound, so any
+	// value still growing after every symbol has had a chance to propagate
+	// must be unbounded.
+	yields := make(map[string]Yield, len(mins))
+	for v, n := range mins {
+		yields[v] = Yield{Min: n, Max: n}
+	}
+	for pass, changed := 0, true; changed; pass++ {
+		changed = false
+		for v, rset := range g {
+			y, ok := yields[v]
+			if !ok {
+				continue
+			}
+			for _, rhs := range rset.Rules {
+				if ry, ok := g.Yield(rhs, yields); ok && ry.Max > y.Max {
+					y.Max = ry.Max
+					if pass > len(yields) {
+						y.Max = Unbounded
+					}
+					yields[v] = y
+					changed = true
+				}
+			}
+		}
+	}
+	return yields
+}
+
+func (g Grammar) minYield(rhs []*Node, mins map[string]int) (int, bool) {
+	total := 0
+	for _, n := range rhs {
+		switch n.Type {
+		case SVar:
+			min, ok := mins[n.Value]
+			if !ok {
+				return 0, false
+			}
+			total = saturate(total + min)
+		default:
+			total = saturate(total + 1)
+		}
+	}
+	return total, true
+}
+
+// Yield finds the yield of a sequence of symbols, given the yields of all of
+// the syntax variables; it fails if any of them cannot derive a finite string.
+func (g Grammar) Yield(rhs []*Node, yields map[string]Yield) (Yield, bool) {
+	total := Yield{}
+	for _, n := range rhs {
+		switch n.Type {
+		case SVar:
+			y, ok := yields[n.Value]
+			if !ok {
+				return Yield{}, false
+			}
+			total = total.Then(y)
+		default:
+			total = total.Then(Yield{1, 1})
+		}
+	}
+	return total, true
+}
+
+// Tempered returns a copy of the grammar with the weights of each rule set
+// raised to the power 1/temp, and rescaled to the same total. Temperatures
+// below 1 make the most common rules even more common; temperatures above 1
+// even out the differences between rules.
+func (g Grammar) Tempered(temp float64) Grammar {
+	if temp == 1 {
+		return g
+	}
+	ng := make(Grammar, len(g))
+	for v, rset := range g {
+		weights := make([]float64, len(rset.Weights))
+		sum := 0.0
+		for i, w := range rset.Weights {
+			weights[i] = math.Pow(w, 1/temp)
+			sum += weights[i]
+		}
+		if sum > 0 {
+			for i := range weights {
+				weights[i] *= rset.total / sum
+			}
+		}
+		ng[v] = &RuleSet{
+			total:   rset.total,
+			Weights: weights,
+			Rules:   rset.Rules,
+		}
+	}
+	return ng
+}
@@ -13,23 +13,88 @@ func InterpretNumber(n *Node) float64 {
 	return freq
 }
 
-func InterpretClass(n *Node) *CharClass {
-	list := make([]string, 0, 10)
-	weights := make(CharSet, 10)
+func InterpretClass(n *Node, inv *Inventory) *CharClass {
+	list := make([]ID, 0, 10)
+	weights := NewCharSet(inv.Len())
 	for sn := n.Left; sn != nil; sn = sn.Right {
 		fnode := sn.Left
-		phoneme := fnode.Left.Value
+		phoneme := inv.Intern(fnode.Left.Value)
 		freq := InterpretNumber(fnode.Right)
 
-		if _, ok := weights[phoneme]; ok {
-			weights[phoneme] += freq
-		} else {
-			weights[phoneme] = freq
+		if !weights.Has(phoneme) {
 			list = append(list, phoneme)
 		}
+		weights.Add(phoneme, freq)
 	}
 	return &CharClass{
 		List:    list,
 		Weights: weights,
 	}
 }
+
+// CombineClasses applies a set operation to two classes. For union (|),
+// the weights of phonemes in both classes are added; for intersection (&),
+// they are multiplied. Difference (-) keeps the weights of the phonemes
+// left in a, and override (^) keeps the members of a, but takes the weights
+// of any that are also in b from b. Concatenation (++) creates a new phoneme
+// for every phoneme of a followed by one of b, spelled by joining their
+// names, with the product of their weights.
+func CombineClasses(op string, a *CharClass, b *CharClass, inv *Inventory) *CharClass {
+	list := make([]ID, 0, len(a.List)+len(b.List))
+	weights := NewCharSet(len(a.Weights.Weights))
+	keep := func(k ID, w float64) {
+		list = append(list, k)
+		weights.Add(k, w)
+	}
+
+	switch op {
+	case "|":
+		for _, k := range a.List {
+			keep(k, a.Weights.Weight(k)+b.Weights.Weight(k))
+		}
+		for _, k := range b.List {
+			if !a.Contains(k) {
+				keep(k, b.Weights.Weight(k))
+			}
+		}
+	case "&":
+		for _, k := range a.List {
+			if b.Contains(k) {
+				keep(k, a.Weights.Weight(k)*b.Weights.Weight(k))
+			}
+		}
+	case "-":
+		for _, k := range a.List {
+			if !b.Contains(k) {
+				keep(k, a.Weights.Weight(k))
+			}
+		}
+	case "^":
+		for _, k := range a.List {
+			if b.Contains(k) {
+				keep(k, b.Weights.Weight(k))
+			} else {
+				keep(k, a.Weights.Weight(k))
+			}
+		}
+	case "++":
+		for _, i := range a.List {
+			for _, j := range b.List {
+				k := inv.Intern(inv.Name(i) + inv.Name(j))
+				if weights.Has(k) {
+					// different pairs can spell the same phoneme
+					weights.Add(k, a.Weights.Weight(i)*b.Weights.Weight(j))
+					continue
+				}
+				keep(k, a.Weights.Weight(i)*b.Weights.Weight(j))
+			}
+		}
+	default:
+		panic(fmt.Sprintf("Invalid Class Operator: %s", op))
+	}
+
+	return &CharClass{
+		List:    list,
+		Weights: weights,
+	}
+}
@@ -0,0 +1,81 @@
+package interpreter
+
+import "strconv"
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// class interprets a literal class written as in a configuration file,
+// without the brackets, such as "p *2 t k".
+func class(inv *Inventory, src string) *CharClass {
+	var items []*Node
+	for _, f := range strings.Fields(src) {
+		if f[0] == '*' {
+			items[len(items)-1].Right.Value = f[1:]
+			continue
+		}
+		items = append(items, &Node{
+			Type:  Freq,
+			Left:  &Node{Type: Phoneme, Value: f},
+			Right: &Node{Type: Num, Value: "1"},
+		})
+	}
+	var list *Node
+	for i := len(items) - 1; i >= 0; i-- {
+		list = &Node{Type: Seq, Left: items[i], Right: list}
+	}
+	return InterpretClass(&Node{Type: Class, Left: list}, inv)
+}
+
+// show writes a class in the same form as class reads it, in its own order.
+func show(inv *Inventory, c *CharClass) string {
+	var parts []string
+	for _, k := range c.List {
+		parts = append(parts, inv.Name(k))
+		if w := c.Weights.Weight(k); w != 1 {
+			parts = append(parts, "*"+strconv.FormatFloat(w, 'g', -1, 64))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestClassOperators(t *testing.T) {
+	tests := []struct {
+		op   string
+		want string
+	}{
+		{"|", "p *2 t *4 k h"},
+		{"&", "t *3"},
+		{"-", "p *2 k"},
+		{"^", "p *2 t *3 k"},
+	}
+	for _, test := range tests {
+		inv := NewInventory()
+		a := class(inv, "p *2 t k")
+		b := class(inv, "t *3 h")
+		if got := show(inv, CombineClasses(test.op, a, b, inv)); got != test.want {
+			t.Errorf("<p *2 t k> %s <t *3 h> = <%s>, want <%s>", test.op, got, test.want)
+		}
+	}
+}
+
+func TestConcatenation(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"p t *2 k", "ʰ", "pʰ tʰ *2 kʰ"},
+		{"p *2 t", "a *3 i", "pa *6 pi *2 ta *3 ti"},
+		// <a><bc> and <ab><c> spell the same new phoneme
+		{"a ab", "bc c", "abc *2 ac abbc"},
+	}
+	for _, test := range tests {
+		inv := NewInventory()
+		a := class(inv, test.a)
+		b := class(inv, test.b)
+		if got := show(inv, CombineClasses("++", a, b, inv)); got != test.want {
+			t.Errorf("<%s> ++ <%s> = <%s>, want <%s>", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -27,22 +27,65 @@ func numberState(in *RuneBuffer, out chan *Item) StateFn {
 	return switchState
 }
 
+// nameOps are operators that can directly follow a variable name, as in
+// "on #V:" or "#A&#B". They only end a name when a space or a class comes
+// next, so that names like "$a:b" are still read whole; "+" likewise only
+// ends a name as part of "++".
+const nameOps = ":&|^"
+
 func symbolState(in *RuneBuffer, out chan *Item) StateFn {
 	buf := new(bytes.Buffer)
 	for {
-		r, ok, _ := in.AcceptNot(" \t\r\n;*<>-!=")
+		r, ok, _ := in.AcceptNot(" \t\r\n;*<>-!=[)")
 		if !ok {
 			break
 		}
+		next, more := in.Peek()
+		switch {
+		case r == '+' && more && next == '+':
+			in.Next()
+			out <- &Item{Type: "symbol", Token: buf.String()}
+			out <- &Item{Type: "++", Token: "++"}
+			return switchState
+		case strings.IndexRune(nameOps, r) >= 0 && (!more || strings.IndexRune(" \t\r\n#<[)", next) >= 0):
+			out <- &Item{Type: "symbol", Token: buf.String()}
+			out <- &Item{Type: string(r), Token: string(r)}
+			return switchState
+		}
 		buf.WriteRune(r)
 	}
 
 	out <- &Item{Type: "symbol", Token: buf.String()}
+	if r, ok := in.Peek(); ok && r == '[' {
+		return indexState
+	}
+	return switchState
+}
+
+// indexState lexes the parameters in brackets directly after a variable
+// name, as in "$W[h]", as a single token.
+func indexState(in *RuneBuffer, out chan *Item) StateFn {
+	in.Next() // skip [
+	buf := new(bytes.Buffer)
+	for {
+		r, ok := in.Next()
+		if !ok || r == ']' {
+			break
+		}
+		buf.WriteRune(r)
+	}
+
+	out <- &Item{Type: "index", Token: buf.String()}
 	return switchState
 }
 
 func arrowState(in *RuneBuffer, out chan *Item) StateFn {
 	first, _ := in.Next()
+	if next, ok := in.Peek(); first == '-' && (!ok || next != '>') {
+		// a lone minus is the class difference operator
+		out <- &Item{Type: "-", Token: "-"}
+		return switchState
+	}
 	second, _ := in.Next()
 
 	out <- &Item{Type: "arrow", Token: string([]rune{first, second})}
@@ -102,6 +145,68 @@ func setState(in *RuneBuffer, out chan *Item) StateFn {
 	}
 }
 
+// matrixState lexes the features between the brackets of a feature matrix,
+// such as "+nasal" or "place=labial", as single tokens.
+func matrixState(in *RuneBuffer, out chan *Item) StateFn {
+	for {
+		r, ok := in.Peek()
+		switch {
+		case !ok:
+			return nil
+		case strings.IndexRune(" \t\r\n", r) >= 0:
+			in.Next()
+		case r == ']':
+			in.Next()
+			out <- &Item{Type: "]", Token: "]"}
+			return switchState
+		default:
+			buf := new(bytes.Buffer)
+			for {
+				r, ok, _ := in.AcceptNot(" \t\r\n]")
+				if !ok {
+					break
+				}
+				buf.WriteRune(r)
+			}
+			out <- &Item{Type: "feature", Token: buf.String()}
+		}
+	}
+}
+
+// closeState lexes a closing parenthesis, and the repetition operator
+// that directly follows it, if there is one: "?", "*", "+", or bounds in
+// braces, like "{1,3}". A "*" followed by a number is a frequency instead,
+// so "(#C | #V)*2" is the same as "(#C | #V) *2".
+func closeState(in *RuneBuffer, out chan *Item) StateFn {
+	in.Next() // skip )
+	out <- &Item{Type: ")", Token: ")"}
+
+	r, ok := in.Peek()
+	switch {
+	case ok && strings.IndexRune("?*+", r) >= 0:
+		in.Next()
+		if next, more := in.Peek(); r == '*' && more && strings.IndexRune("0123456789", next) >= 0 {
+			out <- &Item{Type: "*", Token: "*"}
+			break
+		}
+		out <- &Item{Type: "repeat", Token: string(r)}
+	case ok && r == '{':
+		buf := new(bytes.Buffer)
+		for {
+			r, ok := in.Next()
+			if !ok {
+				break
+			}
+			buf.WriteRune(r)
+			if r == '}' {
+				break
+			}
+		}
+		out <- &Item{Type: "repeat", Token: buf.String()}
+	}
+	return switchState
+}
+
 func switchState(in *RuneBuffer, out chan *Item) StateFn {
 	if r, ok := in.Peek(); ok {
 		for ok { // skip spaces
@@ -121,7 +226,27 @@ func switchState(in *RuneBuffer, out chan *Item) StateFn {
 			in.Next()
 			out <- &Item{Type: "EOL", Token: "EOL"}
 			return commentState
-		case strings.IndexRune("#$_*/=", r) >= 0:
+		case r == '*':
+			in.Next()
+			if next, ok := in.Peek(); ok && next == '>' {
+				in.Next()
+				out <- &Item{Type: "arrow", Token: "*>"}
+			} else {
+				out <- &Item{Type: "*", Token: "*"}
+			}
+			return switchState
+		case r == '+':
+			in.Next()
+			if next, ok := in.Peek(); ok && next == '+' {
+				in.Next()
+				out <- &Item{Type: "++", Token: "++"}
+			} else {
+				out <- &Item{Type: "+", Token: "+"}
+			}
+			return switchState
+		case r == ')':
+			return closeState
+		case strings.IndexRune("#$_/=:&|^(", r) >= 0:
 			in.Next()
 			out <- &Item{Type: string(r), Token: string(r)}
 			return switchState
@@ -129,6 +254,10 @@ func switchState(in *RuneBuffer, out chan *Item) StateFn {
 			in.Next()
 			out <- &Item{Type: "<", Token: "<"}
 			return setState
+		case r == '[':
+			in.Next()
+			out <- &Item{Type: "[", Token: "["}
+			return matrixState
 		case strings.IndexRune("-!", r) >= 0:
 			return arrowState
 		case strings.IndexRune("0123456789", r) >= 0:
@@ -0,0 +1,68 @@
+package main
+
+import "strings"
+import "testing"
+import "github.com/conlang-software-dev/Logopoeist/lexer"
+
+// lex returns the tokens of src up to the end of the first line, as
+// "{type}:{token}" when they differ and as the token alone otherwise.
+func lex(src string) []string {
+	l := lexer.Lex(strings.NewReader(src), switchState)
+	var items []string
+	for {
+		item, ok := l.Next()
+		if !ok || item.Type == "EOL" || item.Type == "EOF" {
+			return items
+		}
+		if item.Type == item.Token {
+			items = append(items, item.Token)
+		} else {
+			items = append(items, item.Type+":"+item.Token)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"$a:b -> #C", "$ symbol:a:b arrow:-> # symbol:C"},
+		{"#C+ = <p>", "# symbol:C+ = < phoneme:p >"},
+		{"#a|b = #c^d", "# symbol:a|b = # symbol:c^d"},
+		{"on #V: #F -> #F", "symbol:on # symbol:V : # symbol:F arrow:-> # symbol:F"},
+		{"#X = #A&#B|<p>", "# symbol:X = # symbol:A & # symbol:B | < phoneme:p >"},
+		{"#X = #A ^ #B", "# symbol:X = # symbol:A ^ # symbol:B"},
+		{"#Asp = #Stop++<h>", "# symbol:Asp = # symbol:Stop ++ < phoneme:h >"},
+		{"$W[h] -> $S[h]", "$ symbol:W index:h arrow:-> $ symbol:S index:h"},
+		{"$S -> (#C|#V)", "$ symbol:S arrow:-> ( # symbol:C | # symbol:V )"},
+		{"$S -> (#C|)", "$ symbol:S arrow:-> ( # symbol:C | )"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(lex(test.src), " "); got != test.want {
+			t.Errorf("%q: tokens %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+// A repetition operator directly follows a group, and "*" with a number is a
+// frequency.
+func TestRepeats(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"$S -> (#C)?", "$ symbol:S arrow:-> ( # symbol:C ) repeat:?"},
+		{"$S -> (#C)* #V", "$ symbol:S arrow:-> ( # symbol:C ) repeat:* # symbol:V"},
+		{"$S -> (#C)+", "$ symbol:S arrow:-> ( # symbol:C ) repeat:+"},
+		{"$S -> (#C){1,3}", "$ symbol:S arrow:-> ( # symbol:C ) repeat:{1,3}"},
+		{"$S -> (#C)*2", "$ symbol:S arrow:-> ( # symbol:C ) * number:2"},
+		{"$S -> (#C) *2", "$ symbol:S arrow:-> ( # symbol:C ) * number:2"},
+		{"$S -> (#C)**2", "$ symbol:S arrow:-> ( # symbol:C ) repeat:* * number:2"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(lex(test.src), " "); got != test.want {
+			t.Errorf("%q: tokens %s, want %s", test.src, got, test.want)
+		}
+	}
+}
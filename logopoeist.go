@@ -4,11 +4,12 @@ import "fmt"
 import "bufio"
 import "os"
 import "flag"
-import "strings"
 
 import "github.com/conlang-software-dev/Logopoeist/lexer"
 import "github.com/conlang-software-dev/Logopoeist/parser"
 import . "github.com/conlang-software-dev/Logopoeist/wordmodel"
+import . "github.com/conlang-software-dev/Logopoeist/charmodel"
+import . "github.com/conlang-software-dev/Logopoeist/types"
 
 func main() {
 	var file *os.File
@@ -16,11 +17,31 @@ func main() {
 	var wcount int
 	var min int
 	var max int
+	var mode string
+	var spelling string
+	var sampling string
+	var threshold float64
+	var temp float64
+	var combine string
+	var gweight float64
+	var nweight float64
+	var precedence string
+	var explain bool
 
 	flag.StringVar(&fname, "file", "", "The name of the configuration file; defaults to standard input.")
 	flag.IntVar(&wcount, "n", 10, "The number of words to generate; defaults to 10.")
 	flag.IntVar(&min, "lmin", 0, "The minimum length of words; defaults to 0.")
 	flag.IntVar(&max, "lmax", 0, "The maximum length of words; defaults to unbounded.")
+	flag.StringVar(&mode, "mode", "generate", "What to do with the model: generate, best, or ambiguity; defaults to generate.")
+	flag.Float64Var(&threshold, "threshold", 0, "In best mode, the minimum probability of words to output; defaults to 0.")
+	flag.Float64Var(&temp, "temperature", 1, "Values below 1 produce more typical words, and above 1 more unusual ones; defaults to 1.")
+	flag.StringVar(&combine, "combine", "product", "How to combine syntax and n-gram weights: product, geometric, grammar, ngram, or maxent; defaults to product.")
+	flag.Float64Var(&gweight, "wgrammar", 1, "The influence of the syntax model with -combine geometric; defaults to 1.")
+	flag.Float64Var(&nweight, "wngram", 1, "The influence of the n-gram model with -combine geometric; defaults to 1.")
+	flag.StringVar(&precedence, "precedence", "intersect", "Which matching condition rules apply: intersect, backoff, or priority; defaults to intersect.")
+	flag.BoolVar(&explain, "explain", false, "List the condition rules that applied to each phoneme of each word.")
+	flag.StringVar(&sampling, "sampling", "backtrack", "How to sample words: backtrack, or exact; defaults to backtrack.")
+	flag.StringVar(&spelling, "spelling", "dedupe", "How to treat words with the same spelling: keep, dedupe, or reject; defaults to dedupe.")
 
 	flag.Parse()
 
@@ -29,6 +50,72 @@ func main() {
 		return
 	}
 
+	spellmode, ok := map[string]int{
+		"keep":   SpellKeep,
+		"dedupe": SpellDedupe,
+		"reject": SpellReject,
+	}[spelling]
+	if !ok {
+		fmt.Printf("spelling must be keep, dedupe, or reject\n")
+		return
+	}
+
+	if temp <= 0 {
+		fmt.Printf("temperature must be positive\n")
+		return
+	}
+
+	combinemode, ok := map[string]int{
+		"product":   CombineProduct,
+		"geometric": CombineGeometric,
+		"grammar":   CombineGrammar,
+		"ngram":     CombineNgram,
+		"maxent":    CombineMaxEnt,
+	}[combine]
+	if !ok {
+		fmt.Printf("combine must be product, geometric, grammar, ngram, or maxent\n")
+		return
+	}
+
+	if gweight < 0 || nweight < 0 || gweight+nweight == 0 {
+		fmt.Printf("wgrammar and wngram must not be negative, or both 0\n")
+		return
+	}
+
+	precedencemode, ok := map[string]int{
+		"intersect": PrecedenceIntersect,
+		"backoff":   PrecedenceBackoff,
+		"priority":  PrecedencePriority,
+	}[precedence]
+	if !ok {
+		fmt.Printf("precedence must be intersect, backoff, or priority\n")
+		return
+	}
+
+	samplemode, ok := map[string]int{
+		"backtrack": SampleBacktrack,
+		"exact":     SampleExact,
+	}[sampling]
+	if !ok {
+		fmt.Printf("sampling must be backtrack or exact\n")
+		return
+	}
+
+	if samplemode == SampleExact && max == 0 {
+		fmt.Printf("exact sampling requires lmax\n")
+		return
+	}
+
+	if mode != "generate" && mode != "best" && mode != "ambiguity" {
+		fmt.Printf("mode must be generate, best, or ambiguity\n")
+		return
+	}
+
+	if mode == "ambiguity" && max == 0 {
+		fmt.Printf("ambiguity analysis requires lmax\n")
+		return
+	}
+
 	if fname != "" {
 		var err error
 		file, err = os.Open(fname)
@@ -52,11 +139,55 @@ func main() {
 	for command := range parser.Parse(lex) {
 		model.Execute(command)
 	}
+	model.SetSpelling(spellmode)
+	model.SetSampling(samplemode)
+	model.SetTemperature(temp)
+	model.SetCombination(combinemode, gweight, nweight)
+	model.SetPrecedence(precedencemode)
+
+	printWord := func(word []ID) {
+		fmt.Printf("%s\n", model.Spell(word))
+		if explain {
+			for _, line := range model.Explain(word) {
+				fmt.Printf("\t%s\n", line)
+			}
+		}
+	}
+
+	if mode == "best" {
+		words, _ := model.Best(wcount, threshold, min, max)
+		for _, word := range words {
+			printWord(word)
+		}
+		if len(words) == 0 {
+			fmt.Printf("No Valid Words Found in the Given Range.")
+		} else if len(words) < wcount && threshold == 0 {
+			fmt.Printf("Exhausted Unique Words in the Given Range.")
+		}
+		return
+	}
+
+	if mode == "ambiguity" {
+		groups := model.Ambiguities(min, max)
+		for i, words := range groups {
+			if i == wcount {
+				break
+			}
+			fmt.Printf("%s:", model.Spell(words[0]))
+			for _, word := range words {
+				fmt.Printf(" %s", model.Segments(word))
+			}
+			fmt.Printf("\n")
+		}
+		if len(groups) == 0 {
+			fmt.Printf("No Ambiguous Spellings Found in the Given Range.")
+		}
+		return
+	}
 
 	for i := 0; i < wcount; i++ {
 		if clist, ok := model.Generate(min, max); ok {
-			word := strings.Join(clist, "")
-			fmt.Printf("%s\n", word)
+			printWord(clist)
 			continue
 		}
 
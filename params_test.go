@@ -0,0 +1,74 @@
+package main
+
+import "fmt"
+import "strings"
+import "testing"
+import "github.com/conlang-software-dev/Logopoeist/environment"
+import "github.com/conlang-software-dev/Logopoeist/wordmodel"
+
+// expand declares the parameters in decls, and expands the command in src.
+func expand(decls string, src string) []string {
+	env := environment.NewEnvironment()
+	for _, cmd := range parseNodes(decls) {
+		env.DeclareParam(cmd)
+	}
+	var cmds []string
+	for _, cmd := range env.ExpandParams(parseNodes(src)[0]) {
+		cmds = append(cmds, strings.TrimSpace(cmd.ToString()))
+	}
+	return cmds
+}
+
+func TestExpandParams(t *testing.T) {
+	const decls = "@param h = front back\n@param s = short long\n"
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"$W[h] -> $W[h] $S[h]\n", []string{
+			"$W[front] -> $W[front] $S[front]",
+			"$W[back] -> $W[back] $S[back]",
+		}},
+		{"$S[h s] -> #C #V[h s]\n", []string{
+			"$S[front short] -> #C #V[front short]",
+			"$S[front long] -> #C #V[front long]",
+			"$S[back short] -> #C #V[back short]",
+			"$S[back long] -> #C #V[back long]",
+		}},
+		{"#V[h long] = #V[h short] ++ <ː>\n", []string{
+			"#V[front long] = #V[front short] ++ <ː>",
+			"#V[back long] = #V[back short] ++ <ː>",
+		}},
+		{"$W -> $W[back] *2\n", []string{"$W -> $W[back] *2"}},
+		{"$W -> $S\n", []string{"$W -> $S"}},
+	}
+	for _, test := range tests {
+		got := expand(decls, test.src)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%q expanded to %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+// checkPanics checks that f panics with a message containing want.
+func checkPanics(t *testing.T, want string, f func()) {
+	defer func() {
+		err := recover()
+		if err == nil || !strings.Contains(fmt.Sprint(err), want) {
+			t.Errorf("panicked with %v, want %q", err, want)
+		}
+	}()
+	f()
+}
+
+func TestParamErrors(t *testing.T) {
+	checkPanics(t, "Unknown parameter or value x in $W[x] -> $S", func() {
+		expand("@param h = front back\n", "$W[x] -> $S\n")
+	})
+	checkPanics(t, "The start symbol $W cannot have parameters", func() {
+		m := wordmodel.WordModel()
+		for _, cmd := range parseNodes("@param h = front back\n$W[h] -> #C\n") {
+			m.Execute(cmd)
+		}
+	})
+}
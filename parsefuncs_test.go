@@ -0,0 +1,106 @@
+package main
+
+import "strings"
+import "testing"
+import "github.com/conlang-software-dev/Logopoeist/lexer"
+import "github.com/conlang-software-dev/Logopoeist/parser"
+
+// parseNodes reads the commands in src, skipping blank lines.
+func parseNodes(src string) []*parser.Node {
+	var cmds []*parser.Node
+	for cmd := range parser.Parse(lexer.Lex(strings.NewReader(src), switchState)) {
+		if cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// parse reads the commands in src, and returns them as parser.Node.ToString
+// shows them.
+func parse(src string) []string {
+	var cmds []string
+	for _, cmd := range parseNodes(src) {
+		cmds = append(cmds, strings.TrimSpace(cmd.ToString()))
+	}
+	return cmds
+}
+
+// checkParse checks that each source line is parsed into the given command.
+func checkParse(t *testing.T, tests map[string]string) {
+	for src, want := range tests {
+		got := parse(src + "\n")
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("%q parsed as %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestParseContexts(t *testing.T) {
+	checkParse(t, map[string]string{
+		"#V * -> #C":        "#V * -> #C",
+		"_ ... <a> -> <a>":  "_ ... <a> -> <a>",
+		"<p> ... * !> <t>":  "<p> ... * !> <t>",
+		"#C #V -> <p *2 t>": "#C #V -> <p *2 t>",
+	})
+}
+
+func TestParsePriority(t *testing.T) {
+	checkParse(t, map[string]string{
+		"<a> -> <p t> @priority 10":  "<a> -> <p t> @priority 10",
+		"#C #V !> <i> @priority 2.5": "#C #V !> <i> @priority 2.5",
+	})
+}
+
+func TestParseBoosts(t *testing.T) {
+	checkParse(t, map[string]string{
+		"#N *> <p t k> *0.5":       "#N *> <p t k> *0.5",
+		"<a> <n> *> <t> *2":        "<a> <n> *> <t> *2",
+		"#N *> <p> *3 @priority 1": "#N *> <p> *3 @priority 1",
+	})
+}
+
+// Class operators apply from left to right.
+func TestParseClassOperators(t *testing.T) {
+	cmds := parseNodes("#Stop = #C & #Voiceless - <h> | #D\n")
+	if len(cmds) != 1 {
+		t.Fatalf("parsed %d commands, want 1", len(cmds))
+	}
+	var ops []string
+	n := cmds[0].Right
+	for ; n.Type == parser.ClassOp; n = n.Left {
+		ops = append(ops, n.Value)
+	}
+	if got := strings.Join(ops, " "); got != "| - &" || n.Value != "C" {
+		t.Errorf("operators from the outside in: %s, innermost operand #%s; want | - &, #C", got, n.Value)
+	}
+}
+
+func TestParseConcatenation(t *testing.T) {
+	checkParse(t, map[string]string{
+		"#Asp = #Stop ++ <ʰ>":       "#Asp = #Stop ++ <ʰ>",
+		"#Asp = #Stop++<ʰ> | #Stop": "#Asp = #Stop ++ <ʰ> | #Stop",
+		"#LongV = <a e> ++ <ː *2>":  "#LongV = <a e> ++ <ː *2>",
+	})
+}
+
+func TestParseMatrices(t *testing.T) {
+	checkParse(t, map[string]string{
+		"#Nasal = [+nasal]":                 "#Nasal = [+nasal]",
+		"#V = [+syllabic -high]":            "#V = [+syllabic -high]",
+		"[αplace] -> [+nasal αplace]":       "[αplace] -> [+nasal αplace]",
+		"#Lab = [place=labial] | <w>":       "#Lab = [place=labial] | <w>",
+		"<m> = [+nasal place=labial +long]": "<m> = [+nasal place=labial +long]",
+	})
+}
+
+func TestParseGroups(t *testing.T) {
+	checkParse(t, map[string]string{
+		"$S -> #C (#V | #V <n> *2)": "$S -> #C (#V | #V <n> *2)",
+		"$S -> (#C | *3) #V":        "$S -> (#C | *3) #V",
+		"$S -> (#C)? #V (#C){1,3}":  "$S -> (#C)? #V (#C){1,3}",
+		"$S -> (#C | #V)*":          "$S -> (#C | #V)*",
+		"$S -> (#C | #V)*2":         "$S -> (#C | #V) *2",
+		"$S -> (#C | #V)* *2":       "$S -> (#C | #V)* *2",
+	})
+}
@@ -1,6 +1,10 @@
 package parser
 
 import "fmt"
+import "strconv"
+import "strings"
+import "unicode"
+import "unicode/utf8"
 import . "github.com/conlang-software-dev/Logopoeist/lexer"
 
 func parseSVar(lex *Lexer) *Node {
@@ -12,6 +16,7 @@ func parseSVar(lex *Lexer) *Node {
 	return &Node{
 		Type:  SVar,
 		Value: symbol.Token,
+		Left:  parseIndex(lex),
 	}
 }
 
@@ -24,9 +29,34 @@ func parseCVar(lex *Lexer) *Node {
 	return &Node{
 		Type:  CVar,
 		Value: symbol.Token,
+		Left:  parseIndex(lex),
 	}
 }
 
+// parseIndex parses the optional list of parameters or parameter values
+// after a variable name, as in "$W[h]", and returns nil if there is none.
+func parseIndex(lex *Lexer) *Node {
+	item, ok := lex.Peek()
+	if !ok || item.Type != "index" {
+		return nil
+	}
+
+	lex.Next() // skip index token
+	fields := strings.Fields(item.Token)
+	if len(fields) == 0 {
+		panic("Parse error: Empty Parameter List")
+	}
+	var index *Node
+	for i := len(fields) - 1; i >= 0; i-- {
+		index = &Node{
+			Type:  Seq,
+			Left:  &Node{Type: Index, Value: fields[i]},
+			Right: index,
+		}
+	}
+	return index
+}
+
 func parsePhoneme(lex *Lexer) *Node {
 loop:
 	symbol, ok := lex.Next()
@@ -65,6 +95,62 @@ func parseClass(lex *Lexer) *Node {
 	}
 }
 
+// parseFeature parses one feature specification in a feature matrix, which
+// is "+{feature}", "-{feature}", "{feature}={value}", or a Greek letter
+// variable followed by the feature, as in "αplace".
+func parseFeature(spec string) *Node {
+	var name string
+	var value *Node
+	first, size := utf8.DecodeRuneInString(spec)
+	switch {
+	case first == '+' || first == '-':
+		name = spec[size:]
+		value = &Node{Type: FeatureValue, Value: spec[:size]}
+	case unicode.Is(unicode.Greek, first) && unicode.IsLower(first):
+		name = spec[size:]
+		value = &Node{Type: FeatureVar, Value: spec[:size]}
+	case strings.Contains(spec, "="):
+		i := strings.Index(spec, "=")
+		name = spec[:i]
+		value = &Node{Type: FeatureValue, Value: spec[i+1:]}
+	}
+	if value == nil || name == "" || value.Value == "" || strings.ContainsAny(name, "+-=") {
+		panic(fmt.Sprintf("Parse error: Invalid Feature %s", spec))
+	}
+	return &Node{
+		Type:  Feature,
+		Value: name,
+		Left:  value,
+	}
+}
+
+func parseMatrix(lex *Lexer) *Node {
+	lex.Next() // skip [ token
+	var features *Node
+	last := &features
+	for {
+		item, ok := lex.Next()
+		if !ok {
+			panic("Parse error: Missing ] in Feature Matrix")
+		}
+		if item.Type == "]" {
+			break
+		}
+		*last = &Node{
+			Type: Seq,
+			Left: parseFeature(item.Token),
+		}
+		last = &(*last).Right
+	}
+	if features == nil {
+		panic("Parse error: Empty Feature Matrix")
+	}
+	return &Node{
+		Type: Matrix,
+		Left: features,
+	}
+}
+
 func parseClassOrCVar(lex *Lexer) *Node {
 	item, ok := lex.Peek()
 	if !ok {
@@ -75,11 +161,37 @@ func parseClassOrCVar(lex *Lexer) *Node {
 		return parseCVar(lex)
 	case "<":
 		return parseClass(lex)
+	case "[":
+		return parseMatrix(lex)
 	default:
 		panic(fmt.Sprintf("Parse error: Expected Character Class or Variable; saw %s", item.Token))
 	}
 }
 
+// parseClassExpr parses a chain of set operations and concatenations on
+// classes, which are applied from left to right.
+func parseClassExpr(lex *Lexer) *Node {
+	left := parseClassOrCVar(lex)
+	for {
+		item, ok := lex.Peek()
+		if !ok {
+			return left
+		}
+		switch item.Type {
+		case "&", "|", "-", "^", "++":
+			lex.Next()
+			left = &Node{
+				Type:  ClassOp,
+				Value: item.Token,
+				Left:  left,
+				Right: parseClassOrCVar(lex),
+			}
+		default:
+			return left
+		}
+	}
+}
+
 func parseSubstitutions(lex *Lexer) *Node {
 	item, ok := lex.Peek()
 	if !ok {
@@ -88,14 +200,18 @@ func parseSubstitutions(lex *Lexer) *Node {
 
 	var left *Node
 	switch item.Type {
-	case "*", "EOL":
+	case "*", "EOL", "EOF", "|", ")":
 		return nil
+	case "(":
+		left = parseGroup(lex)
 	case "$":
 		left = parseSVar(lex)
 	case "#":
 		left = parseCVar(lex)
 	case "<":
 		left = parseClass(lex)
+	case "[":
+		left = parseMatrix(lex)
 	default:
 		panic(fmt.Sprintf("Parse error: Unexpected Token %s in Syntax Rule", item.Token))
 	}
@@ -108,6 +224,91 @@ func parseSubstitutions(lex *Lexer) *Node {
 	}
 }
 
+// parseGroup parses a parenthesized list of alternative replacement lists,
+// each with an optional frequency, and the repetition operator after it, if
+// there is one.
+func parseGroup(lex *Lexer) *Node {
+	lex.Next() // skip ( token
+	var alts *Node
+	last := &alts
+	for {
+		substitutions := parseSubstitutions(lex)
+		frequency := parseFrequency(lex)
+		*last = &Node{
+			Type: Seq,
+			Left: &Node{
+				Type:  Freq,
+				Left:  substitutions,
+				Right: frequency,
+			},
+		}
+		last = &(*last).Right
+
+		item, ok := lex.Next()
+		if !ok || (item.Type != "|" && item.Type != ")") {
+			panic("Parse error: Missing ) in Syntax Rule")
+		}
+		if item.Type == ")" {
+			break
+		}
+	}
+
+	group := &Node{
+		Type: Group,
+		Left: alts,
+	}
+	if item, ok := lex.Peek(); ok && item.Type == "repeat" {
+		lex.Next()
+		return &Node{
+			Type:  Repeat,
+			Value: item.Token,
+			Left:  group,
+			Right: parseBounds(item.Token),
+		}
+	}
+	return group
+}
+
+// parseBounds finds the minimum and maximum numbers of repetitions allowed
+// by a repetition operator, as a list of one or two numbers; the maximum is
+// left out if there is no limit.
+func parseBounds(op string) *Node {
+	var min, max string
+	switch op {
+	case "?":
+		min, max = "0", "1"
+	case "*":
+		min = "0"
+	case "+":
+		min = "1"
+	default:
+		bounds := strings.TrimSuffix(strings.TrimPrefix(op, "{"), "}")
+		if i := strings.Index(bounds, ","); i >= 0 {
+			min, max = bounds[:i], bounds[i+1:]
+		} else {
+			min, max = bounds, bounds
+		}
+		min, max = strings.TrimSpace(min), strings.TrimSpace(max)
+		lo, err := strconv.Atoi(min)
+		hi, err2 := strconv.Atoi(max)
+		if !strings.HasSuffix(op, "}") || err != nil || lo < 0 || (max != "" && (err2 != nil || hi < lo)) {
+			panic(fmt.Sprintf("Parse error: Invalid Repetition %s", op))
+		}
+	}
+
+	bounds := &Node{
+		Type: Seq,
+		Left: &Node{Type: Num, Value: min},
+	}
+	if max != "" {
+		bounds.Right = &Node{
+			Type: Seq,
+			Left: &Node{Type: Num, Value: max},
+		}
+	}
+	return bounds
+}
+
 func parseFrequency(lex *Lexer) *Node {
 	item, ok := lex.Peek()
 	if !ok || item.Type != "*" {
@@ -166,6 +367,17 @@ func parseCondList(lex *Lexer) *Node {
 		left = parseCVar(lex)
 	case "<":
 		left = parseClass(lex)
+	case "[":
+		left = parseMatrix(lex)
+	case "*":
+		lex.Next()
+		left = &Node{Type: Wildcard}
+	case "symbol":
+		if item.Token != "..." {
+			panic(fmt.Sprintf("Parse error: Unexpected Token %s in Condition Expression", item.Token))
+		}
+		lex.Next()
+		left = &Node{Type: Gap}
 	default:
 		panic(fmt.Sprintf("Parse error: Unexpected Token %s in Condition Expression", item.Token))
 	}
@@ -178,6 +390,70 @@ func parseCondList(lex *Lexer) *Node {
 	}
 }
 
+func parseContextList(lex *Lexer) *Node {
+	item, ok := lex.Peek()
+	if !ok {
+		return nil
+	}
+
+	var left *Node
+	switch item.Type {
+	case "EOL", "EOF", "_":
+		return nil
+	case "#":
+		left = parseCVar(lex)
+	case "<":
+		left = parseClass(lex)
+	case "[":
+		left = parseMatrix(lex)
+	default:
+		panic(fmt.Sprintf("Parse error: Unexpected Token %s in Context Expression", item.Token))
+	}
+
+	right := parseContextList(lex)
+	return &Node{
+		Type:  Seq,
+		Left:  left,
+		Right: right,
+	}
+}
+
+func parseContext(lex *Lexer) *Node {
+	lex.Next() // skip / token
+	left := parseContextList(lex)
+
+	item, ok := lex.Next()
+	if !ok || item.Type != "_" {
+		panic("Parse error: Missing _ in Context Expression")
+	}
+
+	right := parseContextList(lex)
+	if item, ok := lex.Peek(); ok && item.Type == "_" {
+		panic("Parse error: Context Expressions must have exactly one _")
+	}
+	return &Node{
+		Type:  Context,
+		Left:  left,
+		Right: right,
+	}
+}
+
+// parsePriority parses an optional `@priority {Number}` annotation, and
+// returns the number, or "" if there is none.
+func parsePriority(lex *Lexer) string {
+	item, ok := lex.Peek()
+	if !ok || item.Type != "symbol" || item.Token != "@priority" {
+		return ""
+	}
+
+	lex.Next() // skip @priority keyword
+	item, ok = lex.Next()
+	if !ok || item.Type != "number" {
+		panic("Parse error: Missing Number after @priority")
+	}
+	return item.Token
+}
+
 func parseCondOrDef(lex *Lexer) *Node {
 	var first *Node
 
@@ -191,6 +467,8 @@ func parseCondOrDef(lex *Lexer) *Node {
 		first = parseCVar(lex)
 	case "<":
 		first = parseClass(lex)
+	case "[":
+		first = parseMatrix(lex)
 	case "_":
 		lex.Next()
 		first = &Node{Type: Boundary}
@@ -207,16 +485,27 @@ func parseCondOrDef(lex *Lexer) *Node {
 	}
 
 	if item.Type == "=" {
-		if first.Type != CVar {
-			panic("Parse error: Unexpected _")
-		}
-
 		lex.Next() // skip = token
-		second := parseClassOrCVar(lex)
-		return &Node{
-			Type:  Definition,
-			Left:  first,
-			Right: second,
+		switch first.Type {
+		case CVar:
+			second := parseClassExpr(lex)
+			return &Node{
+				Type:  Definition,
+				Left:  first,
+				Right: second,
+			}
+		case Class:
+			// the phonemes of the class are given the features
+			if item, ok := lex.Peek(); !ok || item.Type != "[" {
+				panic("Parse error: Expected Feature Matrix in Feature Declaration")
+			}
+			return &Node{
+				Type:  Declaration,
+				Left:  first,
+				Right: parseMatrix(lex),
+			}
+		default:
+			panic("Parse error: Unexpected = in Condition Expression")
 		}
 	} else {
 		rest := parseCondList(lex)
@@ -226,23 +515,67 @@ func parseCondOrDef(lex *Lexer) *Node {
 			panic("Parse error: Missing Arrow in Condition Expression")
 		}
 
-		right := parseClassOrCVar(lex)
+		var right *Node
+		if item, ok := lex.Peek(); ok && item.Type == "_" {
+			lex.Next()
+			right = &Node{Type: Boundary}
+		} else {
+			right = parseClassOrCVar(lex)
+		}
 		left := &Node{
 			Type:  Seq,
 			Left:  first,
 			Right: rest,
 		}
 
+		if item, ok := lex.Peek(); ok && item.Type == "/" {
+			if rest != nil || first.Type == Boundary || right.Type == Boundary {
+				panic("Parse error: Context Expressions require a single target class")
+			}
+			if arrow.Token != "->" && arrow.Token != "!>" {
+				panic("Parse error: Invalid Arrow in Condition Expression")
+			}
+			// the target and distribution form a two-element list
+			left.Right = &Node{
+				Type: Seq,
+				Left: right,
+			}
+			return &Node{
+				Type:  Restriction,
+				Value: arrow.Token,
+				Left:  left,
+				Right: parseContext(lex),
+			}
+		}
+
+		if arrow.Token == "*>" {
+			// the factor applies on top of the weights in the class
+			factor := parseFrequency(lex)
+			return &Node{
+				Type:  Boost,
+				Value: parsePriority(lex),
+				Left:  left,
+				Right: &Node{
+					Type:  Freq,
+					Left:  right,
+					Right: factor,
+				},
+			}
+		}
+
+		priority := parsePriority(lex)
 		switch arrow.Token {
 		case "->":
 			return &Node{
 				Type:  Condition,
+				Value: priority,
 				Left:  left,
 				Right: right,
 			}
 		case "!>":
 			return &Node{
 				Type:  Exclusion,
+				Value: priority,
 				Left:  left,
 				Right: right,
 			}
@@ -252,14 +585,122 @@ func parseCondOrDef(lex *Lexer) *Node {
 	}
 }
 
+// parseQualified parses a condition or exclusion rule that follows a
+// qualifier such as a tier or scope, up to and including its colon.
+func parseQualified(lex *Lexer, what string) *Node {
+	item, ok := lex.Next()
+	if !ok || item.Type != ":" {
+		panic(fmt.Sprintf("Parse error: Expected : after %s", what))
+	}
+
+	item, ok = lex.Peek()
+	if !ok || (item.Type != "#" && item.Type != "<" && item.Type != "[" && item.Type != "_") {
+		panic(fmt.Sprintf("Parse error: Expected Condition Expression after %s", what))
+	}
+	rule := parseCondOrDef(lex)
+	if rule.Type != Condition && rule.Type != Exclusion && rule.Type != Boost {
+		panic(fmt.Sprintf("Parse error: %s applies only to Condition Expressions", what))
+	}
+	if rule.Right.Type == Boundary || rule.Type == Boost && rule.Right.Left.Type == Boundary {
+		panic(fmt.Sprintf("Parse error: Unexpected _ in Condition Expression after %s", what))
+	}
+	return rule
+}
+
+func parseTier(lex *Lexer) *Node {
+	lex.Next() // skip on keyword
+	tier := parseClassOrCVar(lex)
+	rule := parseQualified(lex, "Tier Class")
+	if rule.Type == Boost {
+		panic("Parse error: Tier Class applies only to -> and !> rules")
+	}
+	return &Node{
+		Type:  Tier,
+		Left:  tier,
+		Right: rule,
+	}
+}
+
+func parseScope(lex *Lexer) *Node {
+	lex.Next() // skip in keyword
+	item, ok := lex.Peek()
+	if !ok {
+		panic("Parse error: Expected Syntax or Class Variable")
+	}
+
+	var scope *Node
+	switch item.Type {
+	case "$":
+		scope = parseSVar(lex)
+	case "#":
+		scope = parseCVar(lex)
+	default:
+		panic(fmt.Sprintf("Parse error: Expected Syntax or Class Variable; saw %s", item.Token))
+	}
+	return &Node{
+		Type:  Scope,
+		Left:  scope,
+		Right: parseQualified(lex, "Scope"),
+	}
+}
+
+// parseParam parses a parameter declaration, `@param {name} = {value} ...`.
+func parseParam(lex *Lexer) *Node {
+	lex.Next() // skip @param keyword
+	name, ok := lex.Next()
+	if !ok || name.Type != "symbol" {
+		panic("Parse error: Missing Parameter Name")
+	}
+	if item, ok := lex.Next(); !ok || item.Type != "=" {
+		panic("Parse error: Expected = in Parameter Declaration")
+	}
+
+	var values *Node
+	last := &values
+	for {
+		item, ok := lex.Peek()
+		if !ok || item.Type == "EOL" || item.Type == "EOF" {
+			break
+		}
+		if item.Type != "symbol" && item.Type != "number" {
+			panic(fmt.Sprintf("Parse error: Unexpected Token %s in Parameter Declaration", item.Token))
+		}
+		lex.Next()
+		*last = &Node{
+			Type: Seq,
+			Left: &Node{Type: Index, Value: item.Token},
+		}
+		last = &(*last).Right
+	}
+	if values == nil {
+		panic("Parse error: Missing Parameter Values")
+	}
+	return &Node{
+		Type:  Param,
+		Value: name.Token,
+		Left:  values,
+	}
+}
+
 func parseCommand(lex *Lexer) *Node {
 	item, ok := lex.Peek()
 	for ok && item.Type != "EOF" {
 		switch item.Type {
-		case "#", "_", "<":
+		case "#", "_", "<", "[":
 			return parseCondOrDef(lex)
 		case "$":
 			return parseSyntax(lex)
+		case "symbol":
+			switch item.Token {
+			case "on":
+				return parseTier(lex)
+			case "in":
+				return parseScope(lex)
+			case "@param":
+				return parseParam(lex)
+			default:
+				panic(fmt.Sprintf("Parse error: Unexpected Token %s", item.Token))
+			}
 		case "EOL":
 			lex.Next()
 			item, ok = lex.Peek()
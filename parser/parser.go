@@ -1,6 +1,7 @@
 package parser
 
 import "fmt"
+import "strings"
 import . "github.com/conlang-software-dev/Logopoeist/lexer"
 
 const ( // Node Types
@@ -16,6 +17,23 @@ const ( // Node Types
 	Freq
 	Num
 	Boundary
+	Restriction
+	Context
+	Tier
+	Scope
+	Wildcard
+	Gap
+	Boost
+	ClassOp
+	Matrix
+	Feature
+	FeatureValue
+	FeatureVar
+	Declaration
+	Param
+	Index
+	Group
+	Repeat
 )
 
 type Node struct {
@@ -32,18 +50,41 @@ func (n *Node) ToString() string {
 	switch n.Type {
 	case Production:
 		return fmt.Sprintf("%s -> %s\n", n.Left.ToString(), n.Right.ToString())
-	case Definition:
+	case Definition, Declaration:
 		return fmt.Sprintf("%s = %s\n", n.Left.ToString(), n.Right.ToString())
 	case Condition:
-		return fmt.Sprintf("%s -> %s\n", n.Left.ToString(), n.Right.ToString())
+		return fmt.Sprintf("%s -> %s%s\n", n.Left.ToString(), n.Right.ToString(), priority(n))
 	case Exclusion:
-		return fmt.Sprintf("%s !> %s\n", n.Left.ToString(), n.Right.ToString())
+		return fmt.Sprintf("%s !> %s%s\n", n.Left.ToString(), n.Right.ToString(), priority(n))
+	case Boost:
+		return fmt.Sprintf("%s *> %s%s\n", n.Left.ToString(), n.Right.ToString(), priority(n))
 	case SVar:
-		return fmt.Sprintf("$%s", n.Value)
+		return fmt.Sprintf("$%s%s", n.Value, indices(n))
 	case CVar:
-		return fmt.Sprintf("#%s", n.Value)
+		return fmt.Sprintf("#%s%s", n.Value, indices(n))
+	case Param:
+		return fmt.Sprintf("@param %s = %s\n", n.Value, n.Left.ToString())
+	case Index:
+		return n.Value
+	case Group:
+		alts := make([]string, 0, 2)
+		for sn := n.Left; sn != nil; sn = sn.Right {
+			alts = append(alts, sn.Left.ToString())
+		}
+		return fmt.Sprintf("(%s)", strings.Join(alts, " | "))
+	case Repeat:
+		return n.Left.ToString() + n.Value
 	case Class:
 		return fmt.Sprintf("<%s>", n.Left.ToString())
+	case ClassOp:
+		return fmt.Sprintf("%s %s %s", n.Left.ToString(), n.Value, n.Right.ToString())
+	case Matrix:
+		return fmt.Sprintf("[%s]", n.Left.ToString())
+	case Feature:
+		if n.Left.Type == FeatureVar || n.Left.Value == "+" || n.Left.Value == "-" {
+			return n.Left.Value + n.Value
+		}
+		return fmt.Sprintf("%s=%s", n.Value, n.Left.Value)
 	case Seq:
 		if n.Right == nil {
 			return n.Left.ToString()
@@ -53,6 +94,9 @@ func (n *Node) ToString() string {
 		if n.Right.Value == "1" {
 			return n.Left.ToString()
 		}
+		if n.Left == nil { // an empty alternative in a group
+			return "*" + n.Right.ToString()
+		}
 		return fmt.Sprintf("%s *%s", n.Left.ToString(), n.Right.ToString())
 	case Num:
 		return n.Value
@@ -60,11 +104,40 @@ func (n *Node) ToString() string {
 		return n.Value
 	case Boundary:
 		return "_"
+	case Wildcard:
+		return "*"
+	case Gap:
+		return "..."
+	case Restriction:
+		return fmt.Sprintf("%s %s %s / %s\n", n.Left.Left.ToString(), n.Value, n.Left.Right.Left.ToString(), n.Right.ToString())
+	case Tier:
+		return fmt.Sprintf("on %s: %s", n.Left.ToString(), n.Right.ToString())
+	case Scope:
+		return fmt.Sprintf("in %s: %s", n.Left.ToString(), n.Right.ToString())
+	case Context:
+		if n.Left == nil {
+			return fmt.Sprintf("_ %s", n.Right.ToString())
+		}
+		return fmt.Sprintf("%s _ %s", n.Left.ToString(), n.Right.ToString())
 	default:
 		return "{unknown}"
 	}
 }
 
+func indices(n *Node) string {
+	if n.Left == nil {
+		return ""
+	}
+	return fmt.Sprintf("[%s]", n.Left.ToString())
+}
+
+func priority(n *Node) string {
+	if n.Value == "" {
+		return ""
+	}
+	return fmt.Sprintf(" @priority %s", n.Value)
+}
+
 func Parse(lex *Lexer) chan *Node {
 	nodes := make(chan *Node)
 
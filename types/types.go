@@ -1,13 +1,210 @@
 package types
 
-type CharSet map[string]float64
+import "strings"
+import "math/bits"
+
+// ID is the interned integer identifier of a phoneme.
+type ID int32
+
+// WordBoundary is the ID reserved for the word boundary, written `_`.
+const WordBoundary ID = 0
+
+// Inventory interns phoneme strings into dense IDs, so that the rest of the
+// generation pipeline never has to hash or compare strings.
+type Inventory struct {
+	names []string
+	ids   map[string]ID
+}
+
+func NewInventory() *Inventory {
+	return &Inventory{
+		names: []string{"_"},
+		ids:   map[string]ID{"_": WordBoundary},
+	}
+}
+
+// Intern returns the ID for a phoneme, assigning a new one if necessary.
+func (inv *Inventory) Intern(name string) ID {
+	if id, ok := inv.ids[name]; ok {
+		return id
+	}
+	id := ID(len(inv.names))
+	inv.ids[name] = id
+	inv.names = append(inv.names, name)
+	return id
+}
+
+func (inv *Inventory) Lookup(name string) (ID, bool) {
+	id, ok := inv.ids[name]
+	return id, ok
+}
+
+func (inv *Inventory) Name(id ID) string {
+	return inv.names[id]
+}
+
+// Len returns the number of interned IDs, including the boundary.
+func (inv *Inventory) Len() int {
+	return len(inv.names)
+}
+
+// Spell maps a list of phoneme IDs back to the written form of the word.
+func (inv *Inventory) Spell(word []ID) string {
+	var buf strings.Builder
+	for _, id := range word {
+		buf.WriteString(inv.names[id])
+	}
+	return buf.String()
+}
+
+// Bitset is a set of phoneme IDs.
+type Bitset []uint64
+
+func (b Bitset) Has(id ID) bool {
+	i := int(id) >> 6
+	return i < len(b) && b[i]&(1<<(uint(id)&63)) != 0
+}
+
+func (b *Bitset) Add(id ID) {
+	i := int(id) >> 6
+	for len(*b) <= i {
+		*b = append(*b, 0)
+	}
+	(*b)[i] |= 1 << (uint(id) & 63)
+}
+
+func (b Bitset) Remove(id ID) {
+	if i := int(id) >> 6; i < len(b) {
+		b[i] &^= 1 << (uint(id) & 63)
+	}
+}
+
+func (b Bitset) Len() int {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// Next returns the smallest member of the set that is >= id.
+func (b Bitset) Next(id ID) (ID, bool) {
+	i := int(id) >> 6
+	if i >= len(b) {
+		return 0, false
+	}
+	w := b[i] >> (uint(id) & 63)
+	if w != 0 {
+		return id + ID(bits.TrailingZeros64(w)), true
+	}
+	for i++; i < len(b); i++ {
+		if b[i] != 0 {
+			return ID(i<<6 + bits.TrailingZeros64(b[i])), true
+		}
+	}
+	return 0, false
+}
+
+// Union adds all members of other to the set.
+func (b *Bitset) Union(other Bitset) {
+	for len(*b) < len(other) {
+		*b = append(*b, 0)
+	}
+	for i, w := range other {
+		(*b)[i] |= w
+	}
+}
+
+// Intersect removes all members that are not in other.
+func (b Bitset) Intersect(other Bitset) {
+	for i := range b {
+		if i < len(other) {
+			b[i] &= other[i]
+		} else {
+			b[i] = 0
+		}
+	}
+}
+
+// Subtract removes all members of other from the set.
+func (b Bitset) Subtract(other Bitset) {
+	for i := range b {
+		if i < len(other) {
+			b[i] &^= other[i]
+		}
+	}
+}
+
+func (b Bitset) Copy() Bitset {
+	return append(Bitset(nil), b...)
+}
+
+// CharSet is a weighted set of phonemes, stored densely by ID.
+type CharSet struct {
+	Members Bitset
+	Weights []float64
+}
+
+func NewCharSet(size int) *CharSet {
+	return &CharSet{
+		Members: make(Bitset, (size+63)>>6),
+		Weights: make([]float64, size),
+	}
+}
+
+func (cs *CharSet) Has(id ID) bool {
+	return cs.Members.Has(id)
+}
+
+func (cs *CharSet) Weight(id ID) float64 {
+	if int(id) < len(cs.Weights) {
+		return cs.Weights[id]
+	}
+	return 0
+}
+
+// Add includes a phoneme in the set, summing weights if it was already present.
+func (cs *CharSet) Add(id ID, w float64) {
+	for len(cs.Weights) <= int(id) {
+		cs.Weights = append(cs.Weights, 0)
+	}
+	if cs.Members.Has(id) {
+		cs.Weights[id] += w
+	} else {
+		cs.Members.Add(id)
+		cs.Weights[id] = w
+	}
+}
+
+func (cs *CharSet) Delete(id ID) {
+	cs.Members.Remove(id)
+}
+
+func (cs *CharSet) Len() int {
+	return cs.Members.Len()
+}
+
+// Total returns the sum of the weights of all members.
+func (cs *CharSet) Total() float64 {
+	total := 0.0
+	for id, ok := cs.Members.Next(0); ok; id, ok = cs.Members.Next(id + 1) {
+		total += cs.Weights[id]
+	}
+	return total
+}
+
+func (cs *CharSet) Copy() *CharSet {
+	return &CharSet{
+		Members: cs.Members.Copy(),
+		Weights: append([]float64(nil), cs.Weights...),
+	}
+}
 
 type CharClass struct {
-	List    []string
-	Weights CharSet
+	List    []ID
+	Weights *CharSet
 }
 
-func (c CharClass) Contains(k string) bool {
-	_, ok := c.Weights[k]
-	return ok
+func (c CharClass) Contains(k ID) bool {
+	return c.Weights.Has(k)
 }
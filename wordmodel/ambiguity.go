@@ -0,0 +1,120 @@
+package wordmodel
+
+import "sort"
+import "strings"
+import "encoding/binary"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+import . "github.com/conlang-software-dev/Logopoeist/earley"
+
+const ( // Spelling Modes
+	SpellDedupe = iota // words with the same spelling are only output once
+	SpellKeep          // distinct phoneme sequences are distinct words
+	SpellReject        // words whose spelling has more than one reading are discarded
+)
+
+// SetSpelling selects how words whose spellings collide are treated.
+func (m *model) SetSpelling(mode int) {
+	m.spelling = mode
+	m.explored = nil
+}
+
+// wordKey identifies a word in the set of words already generated.
+func (m *model) wordKey(word []ID) string {
+	if m.spelling != SpellKeep {
+		return m.Spell(word)
+	}
+	buf := make([]byte, 0, 2*len(word))
+	for _, id := range word {
+		buf = binary.AppendUvarint(buf, uint64(id))
+	}
+	return string(buf)
+}
+
+// segment finds every phoneme sequence permitted by the model that is spelled
+// as the given string.
+func (m *model) segment(spelling string) [][]ID {
+	var found [][]ID
+	var seg_rec func(ep *EarleyParser, clist []ID, rest string)
+	seg_rec = func(ep *EarleyParser, clist []ID, rest string) {
+		if rest == "" {
+			if m.ending(ep, clist) > 0 {
+				found = append(found, append([]ID(nil), clist[1:]...))
+			}
+			return
+		}
+
+		dist := m.distribution(ep, clist, 0, 0)
+		for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+			name := m.env.Phonemes.Name(c)
+			if name == "" || !strings.HasPrefix(rest, name) {
+				continue
+			}
+			if np, ok := m.next(ep, clist, c); ok {
+				seg_rec(np, append(clist, c), rest[len(name):])
+			}
+		}
+	}
+
+	seg_rec(m.parser(0), []ID{WordBoundary}, spelling)
+	return found
+}
+
+// enumerate calls yield with every word the model permits in the given
+// length range, in no particular order. The word slice is reused between
+// calls. It will not terminate for an infinite language unless max is set.
+func (m *model) enumerate(min int, max int, yield func([]ID)) {
+	var enum_rec func(ep *EarleyParser, clist []ID)
+	enum_rec = func(ep *EarleyParser, clist []ID) {
+		if m.ending(ep, clist) > 0 && len(clist) > min {
+			yield(clist[1:])
+		}
+		if max > 0 && len(clist) > max {
+			return
+		}
+
+		dist := m.distribution(ep, clist, min, max)
+		for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+			if np, ok := m.next(ep, clist, c); ok {
+				enum_rec(np, append(clist, c))
+			}
+		}
+	}
+
+	enum_rec(m.parser(max), []ID{WordBoundary})
+}
+
+// Ambiguities finds every spelling in the given length range that can be
+// read as more than one phoneme sequence. Each group of readings shares a
+// spelling, and groups are sorted by spelling.
+func (m *model) Ambiguities(min int, max int) [][][]ID {
+	readings := make(map[string][][]ID)
+	m.enumerate(min, max, func(word []ID) {
+		spelling := m.Spell(word)
+		readings[spelling] = append(readings[spelling], append([]ID(nil), word...))
+	})
+
+	spellings := make([]string, 0)
+	for spelling, words := range readings {
+		if len(words) > 1 {
+			spellings = append(spellings, spelling)
+		}
+	}
+	sort.Strings(spellings)
+
+	groups := make([][][]ID, len(spellings))
+	for i, spelling := range spellings {
+		groups[i] = readings[spelling]
+	}
+	return groups
+}
+
+// Segments formats a word with each phoneme shown separately, e.g. `<n><g>`.
+func (m *model) Segments(word []ID) string {
+	var buf strings.Builder
+	for _, id := range word {
+		buf.WriteString("<")
+		buf.WriteString(m.env.Phonemes.Name(id))
+		buf.WriteString(">")
+	}
+	return buf.String()
+}
@@ -0,0 +1,135 @@
+package wordmodel
+
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+
+// ngModel makes a model of words of any number of the phonemes <n>, <g>,
+// <ng> and <a>, so that <n><g> and <ng> are spelled the same way.
+func ngModel() *model {
+	return testModel(
+		production("W", 1, svar("W"), cvar("X")),
+		production("W", 1, cvar("X")),
+		definition("X", class("n", "g", "ng", "a")),
+	)
+}
+
+// generated runs Generate until the words in the length range are used up,
+// and returns them as phonemes separated by spaces.
+func generated(m *model, min int, max int) map[string]bool {
+	found := make(map[string]bool)
+	for {
+		word, ok := m.Generate(min, max)
+		if !ok {
+			return found
+		}
+		names := make([]string, len(word))
+		for i, k := range word {
+			names[i] = m.env.Phonemes.Name(k)
+		}
+		found[strings.Join(names, " ")] = true
+	}
+}
+
+func TestAmbiguities(t *testing.T) {
+	m := ngModel()
+	groups := make(map[string]map[string]bool)
+	for _, group := range m.Ambiguities(1, 3) {
+		spelling := m.Spell(group[0])
+		groups[spelling] = make(map[string]bool)
+		for _, word := range group {
+			if m.Spell(word) != spelling {
+				t.Errorf("%s is grouped with the spelling %q", m.Segments(word), spelling)
+			}
+			groups[spelling][m.Segments(word)] = true
+		}
+	}
+
+	want := map[string][]string{
+		"ng":  {"<n><g>", "<ng>"},
+		"nga": {"<n><g><a>", "<ng><a>"},
+		"ang": {"<a><n><g>", "<a><ng>"},
+	}
+	for spelling, readings := range want {
+		if len(groups[spelling]) != len(readings) {
+			t.Errorf("%q: readings %v, want %v", spelling, groups[spelling], readings)
+			continue
+		}
+		for _, reading := range readings {
+			if !groups[spelling][reading] {
+				t.Errorf("%q: missing reading %s", spelling, reading)
+			}
+		}
+	}
+	for _, spelling := range []string{"a", "an", "ga", "gn"} {
+		if _, ok := groups[spelling]; ok {
+			t.Errorf("%q is reported as ambiguous", spelling)
+		}
+	}
+}
+
+func TestSpellingModes(t *testing.T) {
+	tests := []struct {
+		mode  int
+		count int             // the number of words output, of 20
+		want  map[string]bool // which readings of "ng" are output
+	}{
+		{SpellKeep, 20, map[string]bool{"n g": true, "ng": true}},
+		// every word spelled with "ng" has another reading, if not always one
+		// within the length range
+		{SpellReject, 11, map[string]bool{"n g": false, "ng": false}},
+	}
+	for _, test := range tests {
+		m := ngModel()
+		m.SetSpelling(test.mode)
+		words := generated(m, 1, 2)
+		if len(words) != test.count {
+			t.Errorf("mode %d: %d words output, want %d", test.mode, len(words), test.count)
+		}
+		for word, want := range test.want {
+			if words[word] != want {
+				t.Errorf("mode %d: output %q = %v, want %v", test.mode, word, words[word], want)
+			}
+		}
+	}
+
+	// with dedupe, only one reading of each spelling is output
+	m := ngModel()
+	m.SetSpelling(SpellDedupe)
+	words := generated(m, 1, 2)
+	if len(words) != 19 || words["n g"] == words["ng"] {
+		t.Errorf("dedupe: output %v, want 19 words with one reading of \"ng\"", words)
+	}
+}
+
+// Phonemes made by concatenation are single phonemes, which can be spelled
+// like the sequences they were made from.
+func TestConcatenatedPhonemes(t *testing.T) {
+	m := testModel(
+		production("W", 1, cvar("C"), cvar("V")),
+		definition("Stop", class("p", "t")),
+		definition("C", &Node{Type: ClassOp, Value: "|",
+			Left:  &Node{Type: ClassOp, Value: "++", Left: cvar("Stop"), Right: class("h")},
+			Right: cvar("Stop"),
+		}),
+		definition("V", class("a", "ha")),
+	)
+	m.SetSpelling(SpellKeep)
+	words := allWords(m, 0, 0)
+	for _, word := range []string{"ph a", "th a", "p a", "p ha"} {
+		if !words[word] {
+			t.Errorf("%q not output", word)
+		}
+	}
+	if len(words) != 8 {
+		t.Errorf("%d words output, want 8", len(words))
+	}
+
+	var spellings []string
+	for _, group := range m.Ambiguities(0, 2) {
+		spellings = append(spellings, m.Spell(group[0]))
+	}
+	if got := strings.Join(spellings, " "); got != "pha tha" {
+		t.Errorf("ambiguous spellings %q, want \"pha tha\"", got)
+	}
+}
@@ -0,0 +1,91 @@
+package wordmodel
+
+import "container/heap"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+import . "github.com/conlang-software-dev/Logopoeist/earley"
+
+// candidate is a partial word in the best-first search; if final is set,
+// it is a complete word, rather than a prefix.
+type candidate struct {
+	ep    *EarleyParser
+	clist []ID
+	prob  float64
+	final bool
+}
+
+// frontier is a max-heap of candidates, ordered by probability.
+type frontier []*candidate
+
+func (f frontier) Len() int            { return len(f) }
+func (f frontier) Less(i, j int) bool  { return f[i].prob > f[j].prob }
+func (f frontier) Swap(i, j int)       { f[i], f[j] = f[j], f[i] }
+func (f *frontier) Push(x interface{}) { *f = append(*f, x.(*candidate)) }
+func (f *frontier) Pop() interface{} {
+	old := *f
+	c := old[len(old)-1]
+	*f = old[:len(old)-1]
+	return c
+}
+
+// Best finds the n most probable words in the given length range, in order
+// of decreasing probability, stopping early at words less probable than
+// threshold. Words that have already been generated are skipped, and the
+// words found are treated as generated from then on.
+func (m *model) Best(n int, threshold float64, min int, max int) ([][]ID, []float64) {
+	words := make([][]ID, 0, n)
+	probs := make([]float64, 0, n)
+
+	f := &frontier{{
+		ep:    m.parser(max),
+		clist: []ID{WordBoundary},
+		prob:  1,
+	}}
+	for f.Len() > 0 && len(words) < n {
+		c := heap.Pop(f).(*candidate)
+		if c.prob < threshold {
+			break
+		}
+
+		if c.final {
+			word := c.clist[1:]
+			if m.usable(word) {
+				m.words[m.wordKey(word)] = struct{}{}
+				words = append(words, word)
+				probs = append(probs, c.prob)
+			}
+			continue
+		}
+
+		// Every extension of a prefix is at most as probable as the prefix
+		// itself, so candidates always come off the heap in order.
+		end, next := m.outcomes(c.ep, c.clist)
+		if end > 0 && len(c.clist) > min {
+			heap.Push(f, &candidate{
+				clist: c.clist,
+				prob:  c.prob * end,
+				final: true,
+			})
+		}
+
+		if max > 0 && len(c.clist) > max {
+			continue
+		}
+		allowed := c.ep.AllowedTokens(min, max)
+		for k, ok := next.Members.Next(0); ok; k, ok = next.Members.Next(k + 1) {
+			if !allowed.Has(k) || next.Weights[k] == 0 {
+				continue
+			}
+			if np, ok := m.next(c.ep, c.clist, k); ok {
+				clist := make([]ID, len(c.clist)+1)
+				copy(clist, c.clist)
+				clist[len(c.clist)] = k
+				heap.Push(f, &candidate{
+					ep:    np,
+					clist: clist,
+					prob:  c.prob * next.Weights[k],
+				})
+			}
+		}
+	}
+	return words, probs
+}
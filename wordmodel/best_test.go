@@ -0,0 +1,38 @@
+package wordmodel
+
+import "math"
+import "testing"
+
+// Words without a coda are four times as likely as words with one, so the
+// odds of ending after the vowel are above 1; Best still finds every word,
+// with probabilities that sum to 1.
+func TestBestFinite(t *testing.T) {
+	m := testModel(
+		production("W", 4, svar("S")),
+		production("W", 1, svar("S"), cvar("N")),
+		production("S", 1, cvar("C"), cvar("V")),
+		definition("C", class("p", "t")),
+		definition("V", class("a")),
+		definition("N", class("n")),
+	)
+	want := map[string]float64{
+		"<p><a>":    0.4,
+		"<t><a>":    0.4,
+		"<p><a><n>": 0.1,
+		"<t><a><n>": 0.1,
+	}
+
+	words, probs := m.Best(10, 0, 0, 0)
+	if len(words) != len(want) {
+		t.Fatalf("found %d words, want %d", len(words), len(want))
+	}
+	for i, word := range words {
+		w, ok := want[m.Segments(word)]
+		if !ok || math.Abs(probs[i]-w) > 1e-9 {
+			t.Errorf("%s: probability %v, want %v", m.Segments(word), probs[i], w)
+		}
+		if i > 0 && probs[i] > probs[i-1] {
+			t.Errorf("%s is listed after a less probable word", m.Segments(word))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package wordmodel
+
+import "math"
+import "strconv"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+
+// alt makes an alternative `{rhs} *{freq}` for a group.
+func alt(freq float64, rhs ...*Node) *Node {
+	return &Node{
+		Type:  Freq,
+		Left:  list(rhs...),
+		Right: &Node{Type: Num, Value: strconv.FormatFloat(freq, 'g', -1, 64)},
+	}
+}
+
+// group makes the group `({alt} | ...)`.
+func group(alts ...*Node) *Node {
+	return &Node{Type: Group, Left: list(alts...)}
+}
+
+// repeat makes a repetition of a group between min and max times, or at
+// least min times if max is "".
+func repeat(g *Node, min string, max string) *Node {
+	bounds := []*Node{{Type: Num, Value: min}}
+	if max != "" {
+		bounds = append(bounds, &Node{Type: Num, Value: max})
+	}
+	return &Node{Type: Repeat, Left: g, Right: list(bounds...)}
+}
+
+// checkBest checks that the most probable words of m, up to len(want), have
+// the given probabilities.
+func checkBest(t *testing.T, name string, m *model, want map[string]float64) {
+	words, probs := m.Best(len(want), 0, 0, 0)
+	if len(words) != len(want) {
+		t.Errorf("%s: found %d words, want %d", name, len(words), len(want))
+	}
+	for i, word := range words {
+		w, ok := want[m.Segments(word)]
+		if !ok || math.Abs(probs[i]-w) > 1e-9 {
+			t.Errorf("%s: %s has probability %v, want %v", name, m.Segments(word), probs[i], w)
+		}
+	}
+}
+
+var groupClasses = []*Node{
+	definition("C", class("p")),
+	definition("A", class("a")),
+	definition("I", class("i")),
+	definition("N", class("n")),
+}
+
+// The frequencies in a group divide the frequency of its rule among the
+// alternatives, and leave the rule's share of the whole alone.
+func TestGroupWeights(t *testing.T) {
+	m := testModel(append([]*Node{
+		production("W", 1, cvar("C"), group(alt(3, cvar("A")), alt(1, cvar("I")))),
+		production("W", 1, cvar("N")),
+	}, groupClasses...)...)
+	checkBest(t, "(#A *3 | #I)", m, map[string]float64{
+		"<p><a>": 0.375,
+		"<p><i>": 0.125,
+		"<n>":    0.5,
+	})
+
+	m = testModel(append([]*Node{
+		production("W", 1, cvar("C"), group(alt(1, cvar("A")), alt(1))),
+	}, groupClasses...)...)
+	checkBest(t, "(#A | )", m, map[string]float64{
+		"<p><a>": 0.5,
+		"<p>":    0.5,
+	})
+}
+
+func TestRepetitions(t *testing.T) {
+	tests := []struct {
+		op       string
+		min, max string
+		want     map[string]float64
+	}{
+		{"?", "0", "1", map[string]float64{"<p>": 0.5, "<p><a>": 0.5}},
+		{"{1,3}", "1", "3", map[string]float64{"<p><a>": 1. / 3, "<p><a><a>": 1. / 3, "<p><a><a><a>": 1. / 3}},
+		{"{2}", "2", "2", map[string]float64{"<p><a><a>": 1}},
+		{"*", "0", "", map[string]float64{"<p>": 0.5, "<p><a>": 0.25, "<p><a><a>": 0.125}},
+		{"+", "1", "", map[string]float64{"<p><a>": 0.5, "<p><a><a>": 0.25, "<p><a><a><a>": 0.125}},
+		{"{2,}", "2", "", map[string]float64{"<p><a><a>": 0.5, "<p><a><a><a>": 0.25}},
+	}
+	for _, test := range tests {
+		m := testModel(append([]*Node{
+			production("W", 1, cvar("C"), repeat(group(alt(1, cvar("A"))), test.min, test.max)),
+		}, groupClasses...)...)
+		checkBest(t, "(#A)"+test.op, m, test.want)
+	}
+}
@@ -0,0 +1,149 @@
+package wordmodel
+
+import . "github.com/conlang-software-dev/Logopoeist/types"
+import . "github.com/conlang-software-dev/Logopoeist/earley"
+
+const ( // Sampling Modes
+	SampleBacktrack = iota // sample phonemes, backtracking out of dead ends
+	SampleExact            // sample words from the exact conditional distribution
+)
+
+// SetSampling selects how words are drawn from the model. Exact sampling
+// needs a maximum word length.
+func (m *model) SetSampling(mode int) {
+	m.sampling = mode
+	m.explored = nil
+}
+
+// outcomes finds the probabilities with which the model, left to itself,
+// would end the word at this point, or continue it with each phoneme.
+func (m *model) outcomes(ep *EarleyParser, clist []ID) (float64, *CharSet) {
+	end := m.ending(ep, clist)
+
+	next := m.distribution(ep, clist, 0, 0)
+	if total := next.Total(); total > 0 {
+		for c, ok := next.Members.Next(0); ok; c, ok = next.Members.Next(c + 1) {
+			next.Weights[c] *= (1 - end) / total
+		}
+	} else {
+		next.Members = nil
+		if end > 0 {
+			end = 1 // the word cannot go on
+		}
+	}
+	return end, next
+}
+
+// weigh finds the total probability of every usable word in the given length
+// range that starts with this prefix. Results are kept in the trie, so each
+// prefix is only weighed once, unless reweigh clears it.
+func (m *model) weigh(ep *EarleyParser, node *prefix, clist []ID, min int, max int) float64 {
+	if node.weighed {
+		return node.mass
+	}
+
+	end, next := m.outcomes(ep, clist)
+
+	mass := 0.0
+	if end > 0 && len(clist) > min && !node.ended && m.usable(clist[1:]) {
+		mass += end
+	} else {
+		node.ended = true
+	}
+
+	if max <= 0 || len(clist) <= max {
+		// tokens that cannot finish a word in range have no mass
+		allowed := ep.AllowedTokens(min, max)
+		for c, ok := next.Members.Next(0); ok; c, ok = next.Members.Next(c + 1) {
+			if !allowed.Has(c) || next.Weights[c] == 0 {
+				continue
+			}
+			if np, ok := m.next(ep, clist, c); ok {
+				child := node.child(c)
+				mass += next.Weights[c] * m.weigh(np, child, append(clist, c), min, max)
+			}
+		}
+	}
+
+	node.mass = mass
+	node.weighed = true
+	if mass == 0 {
+		node.exhausted = true
+		node.next = nil
+	}
+	return mass
+}
+
+// reweigh updates the masses along the path to a word that has just been
+// used, from the end of the word back up to the root.
+func (m *model) reweigh(word []ID, min int, max int) {
+	clist := append([]ID{WordBoundary}, word...)
+	eps := []*EarleyParser{m.parser(max)}
+	nodes := []*prefix{m.explored}
+	for i, c := range word {
+		node := nodes[len(nodes)-1].next[c]
+		np, ok := m.next(eps[len(eps)-1], clist[:i+1], c)
+		if node == nil || !node.weighed || !ok {
+			return // the word never had any mass
+		}
+		eps = append(eps, np)
+		nodes = append(nodes, node)
+	}
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i].weighed = false
+		m.weigh(eps[i], nodes[i], clist[:i+1], min, max)
+	}
+}
+
+// use records a word as output, and removes its probability mass, along with
+// that of any other words that can no longer be used, from the trie.
+func (m *model) use(word []ID, min int, max int) {
+	m.words[m.wordKey(word)] = struct{}{}
+
+	readings := [][]ID{word}
+	if m.spelling == SpellDedupe {
+		readings = m.segment(m.Spell(word))
+	}
+	for _, reading := range readings {
+		m.reweigh(reading, min, max)
+	}
+}
+
+// gen_exact draws a word with probability proportional to the probability
+// the model assigns it, among all of the usable words in the length range.
+func (m *model) gen_exact(ep *EarleyParser, node *prefix, clist []ID, min int, max int) ([]ID, bool) {
+	if m.weigh(ep, node, clist, min, max) <= 0 {
+		return nil, false
+	}
+
+	end, next := m.outcomes(ep, clist)
+	r := m.rnd.Float64() * node.mass
+	if !node.ended {
+		r -= end
+		if r <= 0 {
+			word := append([]ID(nil), clist[1:]...)
+			m.use(word, min, max)
+			return word, true
+		}
+	}
+
+	// if rounding leaves r slightly positive, use the last live branch
+	var last ID
+	var found bool
+	for c, child := range node.next {
+		if child.mass <= 0 || !next.Has(c) {
+			continue
+		}
+		last, found = c, true
+		if r -= next.Weights[c] * child.mass; r <= 0 {
+			break
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	np, _ := m.next(ep, clist, last)
+	return m.gen_exact(np, node.next[last], append(clist, last), min, max)
+}
@@ -0,0 +1,176 @@
+package wordmodel
+
+import "math"
+import "math/rand"
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// Exact sampling draws each word with the probability that weigh gives it,
+// which is checked with a chi-square test on a grammar small enough to list
+// every word.
+func TestExactSampling(t *testing.T) {
+	const min, max = 0, 6
+	const draws = 4000
+	cmds := []*Node{
+		production("W", 1, svar("W"), svar("S")),
+		production("W", 1, svar("S")),
+		production("S", 1, cvar("C"), cvar("V")),
+		definition("C", class("p", "t")),
+		definition("V", class("a")),
+	}
+
+	// every word and its unnormalized probability
+	words, probs := testModel(cmds...).Best(1<<20, 0, min, max)
+	if len(words) != 14 {
+		t.Fatalf("found %d words, want 14", len(words))
+	}
+
+	m := testModel(cmds...)
+	m.SetSampling(SampleExact)
+	m.rnd = rand.New(rand.NewSource(1))
+	total := m.weigh(m.parser(max), &prefix{}, []ID{WordBoundary}, min, max)
+	sum := 0.0
+	for _, p := range probs {
+		sum += p
+	}
+	if math.Abs(sum-total) > 1e-9 {
+		t.Fatalf("weigh gives a total of %v, want %v", total, sum)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		// forget earlier draws, so that words can repeat
+		m.words = make(map[string]struct{})
+		m.explored = nil
+		word, ok := m.Generate(min, max)
+		if !ok {
+			t.Fatalf("draw %d failed", i)
+		}
+		counts[m.wordKey(word)]++
+	}
+
+	chi2 := 0.0
+	for i, word := range words {
+		expected := draws * probs[i] / total
+		d := float64(counts[m.wordKey(word)]) - expected
+		chi2 += d * d / expected
+		delete(counts, m.wordKey(word))
+	}
+	if len(counts) > 0 {
+		t.Errorf("drew words outside the grammar: %v", counts)
+	}
+	// the 0.1% critical value for 13 degrees of freedom
+	if chi2 > 34.53 {
+		t.Errorf("chi-square = %.2f with 13 degrees of freedom", chi2)
+	}
+}
+
+// codaModel makes a model of one-syllable words which are three times as
+// likely to have a coda as not, so that the odds of ending after the vowel
+// are 1/3 while going on is still possible.
+func codaModel(onsets ...string) *model {
+	return testModel(
+		production("W", 1, svar("S")),
+		production("W", 3, svar("S"), cvar("N")),
+		production("S", 1, cvar("C"), cvar("V")),
+		definition("C", class(onsets...)),
+		definition("V", class("a")),
+		definition("N", class("n")),
+	)
+}
+
+func TestExactEnding(t *testing.T) {
+	m := codaModel("p")
+	ep := m.parser(0)
+	clist := []ID{WordBoundary}
+	for _, ph := range []string{"p", "a"} {
+		k, _ := m.env.Phonemes.Lookup(ph)
+		ep, _ = ep.Next(k)
+		clist = append(clist, k)
+	}
+	if end, _ := m.outcomes(ep, clist); math.Abs(end-0.25) > 1e-9 {
+		t.Errorf("probability of ending after <p><a> = %v, want 0.25", end)
+	}
+
+	tests := []struct {
+		min, max int
+		want     map[string]bool
+	}{
+		{0, 5, map[string]bool{"p a": true, "p a n": true}},
+		{3, 5, map[string]bool{"p a n": true}},
+		{0, 2, map[string]bool{"p a": true}},
+	}
+	for _, test := range tests {
+		m := codaModel("p")
+		m.SetSampling(SampleExact)
+		got := generated(m, test.min, test.max)
+		if len(got) != len(test.want) {
+			t.Errorf("lengths %d-%d: output %v, want %v", test.min, test.max, got, test.want)
+			continue
+		}
+		for word := range test.want {
+			if !got[word] {
+				t.Errorf("lengths %d-%d: %q not output", test.min, test.max, word)
+			}
+		}
+	}
+}
+
+// Successive draws from the same model never repeat a word, so the second
+// word is drawn from what the first leaves: with probabilities p, the chance
+// of drawing i and then j is p[i] * p[j] / (1 - p[i]).
+func TestExactSuccessiveDraws(t *testing.T) {
+	const trials = 4000
+	probs := map[string]float64{
+		"p a":   1.0 / 8,
+		"t a":   1.0 / 8,
+		"p a n": 3.0 / 8,
+		"t a n": 3.0 / 8,
+	}
+
+	m := codaModel("p", "t")
+	m.SetSampling(SampleExact)
+	m.rnd = rand.New(rand.NewSource(1))
+	counts := make(map[[2]string]int)
+	for i := 0; i < trials; i++ {
+		m.words = make(map[string]struct{})
+		m.explored = nil
+		var pair [2]string
+		for j := range pair {
+			word, ok := m.Generate(0, 5)
+			if !ok {
+				t.Fatalf("trial %d: draw %d failed", i, j)
+			}
+			pair[j] = m.Segments(word)
+		}
+		counts[pair]++
+	}
+
+	chi2 := 0.0
+	for first, p := range probs {
+		for second, q := range probs {
+			if first == second {
+				continue
+			}
+			pair := [2]string{segments(first), segments(second)}
+			expected := trials * p * q / (1 - p)
+			d := float64(counts[pair]) - expected
+			chi2 += d * d / expected
+			delete(counts, pair)
+		}
+	}
+	if len(counts) > 0 {
+		t.Errorf("drew unexpected pairs: %v", counts)
+	}
+	// the 0.1% critical value for 11 degrees of freedom
+	if chi2 > 31.26 {
+		t.Errorf("chi-square = %.2f with 11 degrees of freedom", chi2)
+	}
+}
+
+// segments formats phonemes separated by spaces as Segments does.
+func segments(word string) string {
+	return "<" + strings.Join(strings.Fields(word), "><") + ">"
+}
@@ -1,7 +1,10 @@
 package wordmodel
 
+import "fmt"
+import "sort"
 import "time"
 import "strings"
+import "math"
 import "math/rand"
 import . "github.com/conlang-software-dev/Logopoeist/parser"
 import . "github.com/conlang-software-dev/Logopoeist/types"
@@ -14,81 +17,303 @@ import . "github.com/conlang-software-dev/Logopoeist/earley"
 type model struct {
 	start    string
 	nextvar  int
-	env      Environment
+	env      *Environment
 	synmodel Grammar
 	chrmodel *CharModel
 	rnd      *rand.Rand
 	words    map[string]struct{}
+	spelling int
+	sampling int
+	explored *prefix // explored prefixes, valid for the current length bounds
+	bounds   [2]int
+	parsers  *Cache
+	scopes   map[string]uint64 // bits for the symbols that scope conditions
+	temp     float64
+}
+
+// the number of parser levels kept between calls to Generate
+const parserCacheSize = 1 << 16
+
+// parser returns the root of the shared parser cache for words of at most
+// max phonemes (or any length, if max is 0), creating the cache if the model
+// has changed since the last time it was used.
+func (m *model) parser(max int) *EarleyParser {
+	if m.parsers == nil {
+		m.parsers = NewCache(m.env.Tempered(m.temp), m.synmodel.Tempered(m.temp), m.start, m.scopes, parserCacheSize)
+	}
+	return m.parsers.Within(max)
+}
+
+// prefix is a node in the trie of word prefixes explored by gen_rec. A
+// prefix is exhausted once every word that starts with it has either been
+// used already or is invalid, and is never explored again.
+type prefix struct {
+	next      map[ID]*prefix
+	ended     bool // whether ending the word here has already been tried
+	exhausted bool
+	mass      float64 // probability of all usable words with this prefix
+	weighed   bool
+}
+
+func (p *prefix) child(c ID) *prefix {
+	if p.next == nil {
+		p.next = make(map[ID]*prefix)
+	}
+	next, ok := p.next[c]
+	if !ok {
+		next = &prefix{}
+		p.next[c] = next
+	}
+	return next
 }
 
 func (m *model) addRule(svar string, n *Node) {
 	freq := InterpretNumber(n.Right)
+	m.synmodel.AddRule(svar, m.substitutions(svar, n.Left), freq)
+}
+
+// substitutions converts the replacement list of a syntax rule for svar
+// into a list of variables, adding rules for new variables in place of any
+// literal classes and groups.
+func (m *model) substitutions(svar string, list *Node) []*Node {
 	rule := make([]*Node, 0, 10)
-	for sn := n.Left; sn != nil; sn = sn.Right {
+	for sn := list; sn != nil; sn = sn.Right {
 		subst := sn.Left
 		switch subst.Type {
 		case SVar, CVar:
 			rule = append(rule, subst)
-		case Class:
+		case Class, Matrix:
 			cvar := m.env.AssignNew(subst)
 			rule = append(rule, &Node{
 				Type:  CVar,
 				Value: cvar,
 			})
+		case Group, Repeat:
+			rule = append(rule, &Node{
+				Type:  SVar,
+				Value: m.addGroup(svar, subst),
+			})
 		default:
 			panic("Invalid Node Type in Syntax Rule")
 		}
 	}
+	return rule
+}
 
-	m.synmodel.AddRule(svar, rule, freq)
+// fresh makes a new syntax variable for part of a rule for svar. Its name
+// contains parentheses, so it cannot clash with any written variable.
+func (m *model) fresh(svar string) string {
+	m.nextvar++
+	return fmt.Sprintf("%s(%d)", svar, m.nextvar)
 }
 
-func (m *model) generateNgrams(cond_n *Node) [][]string {
-	var last_ngrams [][]string
+// addGroup adds the rules for a new syntax variable that derives a group of
+// alternatives, or a repetition of one, in a rule for svar, and returns the
+// variable. The weights of the rules for each new variable sum to 1, so that
+// a group divides the frequency of the rule that it is in among its choices,
+// rather than changing it.
+func (m *model) addGroup(svar string, n *Node) string {
+	v := m.fresh(svar)
+	if n.Type == Group {
+		total := 0.0
+		for sn := n.Left; sn != nil; sn = sn.Right {
+			total += InterpretNumber(sn.Left.Right)
+		}
+		for sn := n.Left; sn != nil; sn = sn.Right {
+			freq := InterpretNumber(sn.Left.Right)
+			if total > 0 {
+				freq /= total
+			}
+			m.synmodel.AddRule(v, m.substitutions(svar, sn.Left.Left), freq)
+		}
+		return v
+	}
 
-	sn := cond_n
-	if sn.Left.Type == Boundary {
-		last_ngrams = append(last_ngrams, []string{"_"})
-		sn = sn.Right
-	} else {
-		last_ngrams = append(last_ngrams, []string{})
+	item := &Node{Type: SVar, Value: m.addGroup(svar, n.Left)}
+	repeat := func(k int) []*Node {
+		rule := make([]*Node, k)
+		for i := range rule {
+			rule[i] = item
+		}
+		return rule
+	}
+	min := int(InterpretNumber(n.Right.Left))
+	if n.Right.Right == nil {
+		// each further repetition is as likely as stopping
+		more := m.fresh(svar)
+		m.synmodel.AddRule(more, []*Node{item, {Type: SVar, Value: more}}, 0.5)
+		m.synmodel.AddRule(more, []*Node{}, 0.5)
+		m.synmodel.AddRule(v, append(repeat(min), &Node{Type: SVar, Value: more}), 1)
+		return v
+	}
+	// every number of repetitions in the range is equally likely
+	max := int(InterpretNumber(n.Right.Right.Left))
+	for k := min; k <= max; k++ {
+		m.synmodel.AddRule(v, repeat(k), 1/float64(max-min+1))
 	}
+	return v
+}
 
-	for ; sn != nil; sn = sn.Right {
-		cclass := m.env.GetClass(sn.Left)
-		next_ngrams := make([][]string, 0, cap(last_ngrams)*len(cclass.List))
-		for _, ngram := range last_ngrams {
-			for _, chr := range cclass.List {
-				new_ngram := append(ngram, chr)
-				next_ngrams = append(next_ngrams, new_ngram)
-			}
+// pattern converts a list of conditioning classes and placeholders into a
+// Pattern for the character model.
+func (m *model) pattern(cond_n *Node) Pattern {
+	var pat Pattern
+	for sn := cond_n; sn != nil; sn = sn.Right {
+		switch sn.Left.Type {
+		case Wildcard:
+			pat = append(pat, Element{Kind: MatchAny})
+		case Gap:
+			pat = append(pat, Element{Kind: MatchGap})
+		default:
+			pat = append(pat, Element{
+				Kind:  MatchClass,
+				Class: m.env.GetClass(sn.Left).Weights.Members,
+			})
 		}
-		last_ngrams = next_ngrams
 	}
+	return pat
+}
 
-	return last_ngrams
+// ruleInfo collects the attributes of a condition or exclusion rule, which
+// applies in the given scope, or everywhere if scope is 0. source is the
+// whole command that the rule came from.
+func ruleInfo(rule *Node, source *Node, scope uint64) RuleInfo {
+	info := RuleInfo{
+		Scope:  scope,
+		Source: strings.TrimSpace(source.ToString()),
+	}
+	if rule.Value != "" {
+		info.Priority = InterpretNumber(&Node{Type: Num, Value: rule.Value})
+	}
+	return info
 }
 
-func (m *model) addCondition(cond_n *Node, dist_n *Node) {
+func (m *model) addCondition(cond_n *Node, dist_n *Node, info RuleInfo) {
 	dist := m.env.GetClass(dist_n).Weights
-	for _, ngchars := range m.generateNgrams(cond_n) {
-		ngram := strings.Join(ngchars, "")
-		m.chrmodel.AddCondition(ngram, &dist)
+	m.chrmodel.AddCondition(info, m.pattern(cond_n), dist)
+}
+
+func (m *model) addExclusion(cond_n *Node, dist_n *Node, info RuleInfo) {
+	dist := &m.env.GetClass(dist_n).Weights.Members
+	m.chrmodel.AddExclusion(info, m.pattern(cond_n), dist)
+}
+
+func (m *model) addBoost(cond_n *Node, boost_n *Node, info RuleInfo) {
+	factor := InterpretNumber(boost_n.Right)
+	class := m.env.GetClass(boost_n.Left).Weights
+	factors := class.Copy()
+	for c, ok := factors.Members.Next(0); ok; c, ok = factors.Members.Next(c + 1) {
+		factors.Weights[c] *= factor
 	}
+	m.chrmodel.AddBoost(info, m.pattern(cond_n), factors)
 }
 
-func (m *model) addExclusion(cond_n *Node, dist_n *Node) {
-	dist := m.env.GetClass(dist_n).Weights
-	for _, ngchars := range m.generateNgrams(cond_n) {
-		ngram := strings.Join(ngchars, "")
-		m.chrmodel.AddExclusion(ngram, &dist)
+// classSets looks up the members of each class in a list.
+func (m *model) classSets(list *Node) []Bitset {
+	var sets []Bitset
+	for sn := list; sn != nil; sn = sn.Right {
+		sets = append(sets, m.env.GetClass(sn.Left).Weights.Members)
+	}
+	return sets
+}
+
+func (m *model) addRestriction(n *Node) {
+	target := m.env.GetClass(n.Left.Left).Weights.Members
+	dist := m.env.GetClass(n.Left.Right.Left).Weights.Members
+	left := m.classSets(n.Right.Left)
+	right := m.classSets(n.Right.Right)
+	m.chrmodel.AddRestriction(target, dist, n.Value == "->", left, right)
+}
+
+func (m *model) addTierRule(n *Node) {
+	tier := m.env.GetClass(n.Left).Weights.Members
+	rule := n.Right
+	ctx := m.pattern(rule.Left)
+	dist := m.env.GetClass(rule.Right).Weights
+	if rule.Type == Condition {
+		m.chrmodel.AddTierCondition(tier, ctx, dist)
+	} else {
+		m.chrmodel.AddTierExclusion(tier, ctx, dist.Members)
+	}
+}
+
+// scope finds the bit for a scoping symbol, such as "$Coda" or "#Onset".
+func (m *model) scope(name string) uint64 {
+	if bit, ok := m.scopes[name]; ok {
+		return bit
+	}
+	if len(m.scopes) >= 64 {
+		panic("Too many distinct scopes in condition rules")
+	}
+	if m.scopes == nil {
+		m.scopes = make(map[string]uint64)
+	}
+	bit := uint64(1) << uint(len(m.scopes))
+	m.scopes[name] = bit
+	return bit
+}
+
+func (m *model) addScopedRule(n *Node) {
+	name := "$" + n.Left.Value
+	if n.Left.Type == CVar {
+		name = "#" + n.Left.Value
+	}
+	bit := m.scope(name)
+
+	rule := n.Right
+	info := ruleInfo(rule, n, bit)
+	switch rule.Type {
+	case Condition:
+		m.addCondition(rule.Left, rule.Right, info)
+	case Exclusion:
+		m.addExclusion(rule.Left, rule.Right, info)
+	case Boost:
+		m.addBoost(rule.Left, rule.Right, info)
 	}
 }
 
+// distribution finds the weights of the phonemes that could follow clist in
+// a word with a length between min and max.
+func (m *model) distribution(ep *EarleyParser, clist []ID, min int, max int) *CharSet {
+	if len(m.scopes) == 0 {
+		return m.chrmodel.CalcDistribution(ep.AllowedTokens(min, max), clist)
+	}
+	return m.chrmodel.CalcScoped(ep.ScopedTokens(min, max), clist)
+}
+
+// next advances the parser past the phoneme c following clist, dropping any
+// parses in which c falls in a scope whose conditions forbid it.
+func (m *model) next(ep *EarleyParser, clist []ID, c ID) (*EarleyParser, bool) {
+	if len(m.scopes) == 0 {
+		return m.parsers.Next(ep, c)
+	}
+	return m.parsers.NextIn(ep, c, func(scope uint64) bool {
+		return m.chrmodel.Permits(scope, clist, c)
+	})
+}
+
 func (m *model) Execute(n *Node) {
 	if n == nil || m == nil {
 		return
 	}
+	m.parsers = nil
+	m.explored = nil
+	if n.Type == Param {
+		m.env.DeclareParam(n)
+		return
+	}
+
+	cmds := m.env.ExpandParams(n)
+	if n.Type == Production && m.start == "" && cmds[0].Left.Value != cmds[len(cmds)-1].Left.Value {
+		panic(fmt.Sprintf("The start symbol $%s cannot have parameters", n.Left.Value))
+	}
+	for _, cmd := range cmds {
+		m.execute(cmd)
+	}
+}
+
+// execute runs a command, with any parameters in it already bound.
+func (m *model) execute(n *Node) {
 	switch n.Type {
 	case Production:
 		m.addRule(n.Left.Value, n.Right)
@@ -97,50 +322,80 @@ func (m *model) Execute(n *Node) {
 		}
 	case Definition:
 		m.env.Assign(n.Left.Value, n.Right)
+	case Declaration:
+		m.env.Declare(n.Left, n.Right)
+	default:
+		for _, rule := range m.env.Expand(n) {
+			m.executeRule(rule)
+		}
+	}
+}
+
+// executeRule adds a conditional probability rule, with any feature
+// variables in it already bound.
+func (m *model) executeRule(n *Node) {
+	switch n.Type {
 	case Condition:
-		m.addCondition(n.Left, n.Right)
+		m.addCondition(n.Left, n.Right, ruleInfo(n, n, 0))
 	case Exclusion:
-		m.addExclusion(n.Left, n.Right)
+		m.addExclusion(n.Left, n.Right, ruleInfo(n, n, 0))
+	case Boost:
+		m.addBoost(n.Left, n.Right, ruleInfo(n, n, 0))
+	case Restriction:
+		m.addRestriction(n)
+	case Tier:
+		m.addTierRule(n)
+	case Scope:
+		m.addScopedRule(n)
 	}
 }
 
-func (m *model) gen_rec(ep *EarleyParser, clist []string, min int, max int) ([]string, bool) {
+func (m *model) gen_rec(ep *EarleyParser, node *prefix, clist []ID, min int, max int) ([]ID, bool) {
+
+	finalize := func() ([]ID, bool) {
+		if node.ended {
+			return nil, false
+		}
+		// whether or not this succeeds, the word can never be produced again
+		node.ended = true
 
-	finalize := func() ([]string, bool) {
 		final := clist[1:]
-		word := strings.Join(final, "")
-		if _, ok := m.words[word]; !ok {
-			m.words[word] = struct{}{}
-			return final, true
+		if !m.usable(final) {
+			return nil, false
 		}
-		return nil, false
+		m.words[m.wordKey(final)] = struct{}{}
+		return final, true
 	}
 
-	recurse := func() ([]string, bool) {
+	recurse := func() ([]ID, bool) {
 		if max > 0 && len(clist) > max {
 			return nil, false
 		}
 
-		base := ep.AllowedTokens()
-		dist := m.chrmodel.CalcDistribution(base, clist)
-
-		total := 0.0
-		for _, w := range dist {
-			total += w
+		dist := m.distribution(ep, clist, min, max)
+		for c, next := range node.next {
+			if next.exhausted {
+				dist.Delete(c)
+			}
 		}
+		total := dist.Total()
 
-		for len(dist) > 0 {
+		for dist.Len() > 0 {
 			r := m.rnd.Float64() * total
-			for c, w := range dist {
+			for c, ok := dist.Members.Next(0); ok; c, ok = dist.Members.Next(c + 1) {
+				w := dist.Weights[c]
 				r -= w
 				if r <= 0 {
 					total -= w
-					delete(dist, c)
+					dist.Delete(c)
 
-					if np, ok := ep.Next(c); ok {
-						if nclist, ok := m.gen_rec(np, append(clist, c), min, max); ok {
+					child := node.child(c)
+					if np, ok := m.next(ep, clist, c); ok {
+						if nclist, ok := m.gen_rec(np, child, append(clist, c), min, max); ok {
 							return nclist, true
 						}
+					} else {
+						child.exhausted = true
 					}
 					break
 				}
@@ -149,10 +404,11 @@ func (m *model) gen_rec(ep *EarleyParser, clist []string, min int, max int) ([]s
 		return nil, false
 	}
 
-	if ep.IsFinished() && len(clist) > min {
-		var attempt func() ([]string, bool)
-		var fallback func() ([]string, bool)
-		if m.rnd.Float64() < ep.TerminationProbability() {
+	ending := m.ending(ep, clist)
+	if ending > 0 && len(clist) > min && !node.ended {
+		var attempt func() ([]ID, bool)
+		var fallback func() ([]ID, bool)
+		if m.rnd.Float64() < ending {
 			attempt = finalize
 			fallback = recurse
 		} else {
@@ -162,27 +418,179 @@ func (m *model) gen_rec(ep *EarleyParser, clist []string, min int, max int) ([]s
 		if nclist, ok := attempt(); ok {
 			return nclist, true
 		}
-		return fallback()
+		if nclist, ok := fallback(); ok {
+			return nclist, true
+		}
+	} else if nclist, ok := recurse(); ok {
+		return nclist, true
 	}
 
-	return recurse()
+	// every word starting with this prefix is used up or invalid
+	node.exhausted = true
+	node.next = nil
+	return nil, false
 }
 
-func (m *model) Generate(min int, max int) ([]string, bool) {
-	clist := make([]string, 1, 10)
-	clist[0] = "_"
+func (m *model) Generate(min int, max int) ([]ID, bool) {
+	if m.explored == nil || m.bounds != [2]int{min, max} {
+		m.explored = &prefix{}
+		m.bounds = [2]int{min, max}
+	}
+	if m.explored.exhausted {
+		return nil, false
+	}
+
+	clist := make([]ID, 1, 10)
+	clist[0] = WordBoundary
+
+	if m.sampling == SampleExact {
+		return m.gen_exact(m.parser(max), m.explored, clist, min, max)
+	}
+	return m.gen_rec(m.parser(max), m.explored, clist, min, max)
+}
+
+// ending finds the probability of ending the word after clist rather than
+// going on, from the odds given by the parser's TerminationProbability and any
+// word-final conditions. It is 0 if the word cannot end here.
+func (m *model) ending(ep *EarleyParser, clist []ID) float64 {
+	if !ep.IsFinished() {
+		return 0
+	}
+	weight := m.endWeight(ep, clist)
+	if weight == 0 {
+		return 0
+	}
+	odds := ep.TerminationProbability() * weight
+	if math.IsInf(odds, 1) {
+		return 1
+	}
+	return odds / (1 + odds)
+}
+
+// endWeight finds the factor by which conditions scale the odds of ending the
+// word after clist, averaged over the sets of scopes in which the last phoneme
+// could have been chosen by the parses that end here.
+func (m *model) endWeight(ep *EarleyParser, clist []ID) float64 {
+	if len(m.scopes) == 0 || len(clist) < 2 {
+		return m.chrmodel.EndWeight(clist, 0)
+	}
+	c := clist[len(clist)-1]
+	prev := clist[:len(clist)-1]
+	shares := ep.EndScopes(c, func(scope uint64) bool {
+		return m.chrmodel.Permits(scope, prev, c)
+	})
+	weight := 0.0
+	total := 0.0
+	for scope, share := range shares {
+		weight += share * m.chrmodel.EndWeight(clist, scope)
+		total += share
+	}
+	if total == 0 {
+		return m.chrmodel.EndWeight(clist, 0)
+	}
+	return weight / total
+}
+
+// usable checks whether a word could be output without repeating an earlier
+// one, or being rejected for an ambiguous spelling.
+func (m *model) usable(word []ID) bool {
+	if _, ok := m.words[m.wordKey(word)]; ok {
+		return false
+	}
+	return m.spelling != SpellReject || len(m.segment(m.Spell(word))) <= 1
+}
+
+// SetTemperature flattens (temp > 1) or sharpens (temp < 1) the weights of
+// syntax rules, class phonemes and conditional rules used by later calls to
+// Generate and Best. Each weight is tempered once: the grammar's and the
+// classes' in parser, and the conditional rules' in the CharModel. It is set
+// for the whole model rather than per call because the parser cache and the
+// trie of explored prefixes hold weights at one temperature, and are thrown
+// away when it changes.
+func (m *model) SetTemperature(temp float64) {
+	if temp == m.temp {
+		return
+	}
+	m.temp = temp
+	m.chrmodel.SetTemperature(temp)
+	m.parsers = nil
+	m.explored = nil
+}
+
+// SetCombination selects how the syntax and n-gram models are combined; see
+// CharModel.SetCombination.
+func (m *model) SetCombination(mode int, gweight float64, nweight float64) {
+	m.chrmodel.SetCombination(mode, gweight, nweight)
+	m.explored = nil
+}
+
+// SetPrecedence selects which of the condition rules that match a context
+// apply; see CharModel.SetPrecedence.
+func (m *model) SetPrecedence(mode int) {
+	m.chrmodel.SetPrecedence(mode)
+	// scoped rules decide which parses survive each phoneme
+	m.parsers = nil
+	m.explored = nil
+}
+
+// Explain lists, for each phoneme in a word, the condition and exclusion
+// rules that applied to it, as "{phoneme}: {rule}; {rule}...".
+func (m *model) Explain(word []ID) []string {
+	lines := make([]string, 0, len(word))
+	clist := []ID{WordBoundary}
+	ep := m.parser(0)
+	for _, c := range word {
+		// the rules of each set of scopes in which c could have been chosen;
+		// the sets are kept apart, since rules from different parses never
+		// apply together
+		tokens := ep.ScopedTokens(0, 0)
+		scopes := make([]uint64, 0, len(tokens))
+		for scope, cset := range tokens {
+			if cset.Has(c) && m.chrmodel.Permits(scope, clist, c) {
+				scopes = append(scopes, scope)
+			}
+		}
+		sort.Slice(scopes, func(i, j int) bool { return scopes[i] < scopes[j] })
+
+		var rules []string
+		seen := make(map[string]bool)
+		for _, scope := range scopes {
+			for _, rule := range m.chrmodel.Explain(clist, scope) {
+				if !seen[rule] {
+					seen[rule] = true
+					rules = append(rules, rule)
+				}
+			}
+		}
+		if len(rules) == 0 {
+			rules = []string{"(no rules)"}
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", m.env.Phonemes.Name(c), strings.Join(rules, "; ")))
+
+		var ok bool
+		if ep, ok = m.next(ep, clist, c); !ok {
+			break
+		}
+		clist = append(clist, c)
+	}
+	return lines
+}
 
-	ep := NewParser(m.env, m.synmodel, m.start)
-	return m.gen_rec(ep, clist, min, max)
+// Spell maps a generated list of phoneme IDs back to its written form.
+func (m *model) Spell(word []ID) string {
+	return m.env.Phonemes.Spell(word)
 }
 
 func WordModel() *model {
 	return &model{
 		start:    "",
-		env:      make(Environment),
+		env:      NewEnvironment(),
 		synmodel: make(Grammar),
 		chrmodel: NewModel(),
 		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
 		words:    make(map[string]struct{}),
+		spelling: SpellDedupe,
+		sampling: SampleBacktrack,
+		temp:     1,
 	}
 }
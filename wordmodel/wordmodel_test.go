@@ -0,0 +1,346 @@
+package wordmodel
+
+import "math"
+import "strconv"
+import "strings"
+import "testing"
+import . "github.com/conlang-software-dev/Logopoeist/parser"
+import . "github.com/conlang-software-dev/Logopoeist/types"
+
+// list links nodes into a Seq list.
+func list(nodes ...*Node) *Node {
+	var l *Node
+	for i := len(nodes) - 1; i >= 0; i-- {
+		l = &Node{Type: Seq, Left: nodes[i], Right: l}
+	}
+	return l
+}
+
+// class makes a literal class from phonemes, each with a frequency of 1.
+func class(phonemes ...string) *Node {
+	items := make([]*Node, len(phonemes))
+	for i, ph := range phonemes {
+		items[i] = &Node{
+			Type:  Freq,
+			Left:  &Node{Type: Phoneme, Value: ph},
+			Right: &Node{Type: Num, Value: "1"},
+		}
+	}
+	return &Node{Type: Class, Left: list(items...)}
+}
+
+func svar(name string) *Node {
+	return &Node{Type: SVar, Value: name}
+}
+
+func cvar(name string) *Node {
+	return &Node{Type: CVar, Value: name}
+}
+
+// production makes the syntax rule `$lhs -> {rhs} *{freq}`.
+func production(lhs string, freq float64, rhs ...*Node) *Node {
+	return &Node{
+		Type: Production,
+		Left: svar(lhs),
+		Right: &Node{
+			Type:  Freq,
+			Left:  list(rhs...),
+			Right: &Node{Type: Num, Value: strconv.FormatFloat(freq, 'g', -1, 64)},
+		},
+	}
+}
+
+// definition makes the variable declaration `#name = {value}`.
+func definition(name string, value *Node) *Node {
+	return &Node{Type: Definition, Left: cvar(name), Right: value}
+}
+
+// condition makes the rule `{ctx} -> {dist}`.
+func condition(dist *Node, ctx ...*Node) *Node {
+	return &Node{Type: Condition, Left: list(ctx...), Right: dist}
+}
+
+// testModel makes a model from a list of commands.
+func testModel(cmds ...*Node) *model {
+	m := WordModel()
+	for _, cmd := range cmds {
+		m.Execute(cmd)
+	}
+	return m
+}
+
+// allWords lists every word the model can produce in the length range, as
+// phonemes separated by spaces.
+func allWords(m *model, min int, max int) map[string]bool {
+	words, _ := m.Best(1<<20, 0, min, max)
+	found := make(map[string]bool, len(words))
+	for _, word := range words {
+		names := make([]string, len(word))
+		for i, k := range word {
+			names[i] = m.env.Phonemes.Name(k)
+		}
+		found[strings.Join(names, " ")] = true
+	}
+	return found
+}
+
+// Conditions match phonemes, not spellings, so a rule for <t> <s> never
+// applies after the single phoneme <ts>.
+func TestDigraphContexts(t *testing.T) {
+	m := testModel(
+		production("W", 1, cvar("X"), cvar("X"), cvar("X")),
+		definition("X", class("t", "s", "ts", "a")),
+		condition(class("a"), class("t"), class("s")),
+	)
+	m.SetSpelling(SpellKeep)
+	words := allWords(m, 3, 3)
+
+	for word := range words {
+		if strings.HasPrefix(word, "t s ") && word != "t s a" {
+			t.Errorf("%q: <t> <s> -> <a> did not apply", word)
+		}
+	}
+	for _, word := range []string{"ts t s", "ts ts t", "t ts s", "t ts ts", "a t ts"} {
+		if !words[word] {
+			t.Errorf("%q: <t> <s> -> <a> applied after <ts>", word)
+		}
+	}
+}
+
+// Different sequences of phonemes with the same spelling are still different
+// words, unless the spelling mode merges them.
+func TestDigraphWords(t *testing.T) {
+	cmds := []*Node{
+		production("W", 1, cvar("X"), cvar("X")),
+		definition("X", class("a", "bc", "ab", "c")),
+	}
+
+	m := testModel(cmds...)
+	m.SetSpelling(SpellKeep)
+	words := allWords(m, 2, 2)
+	if !words["a bc"] || !words["ab c"] {
+		t.Errorf("<a><bc> and <ab><c> are not both words: %v", words)
+	}
+	abc := m.env.Phonemes
+	a, _ := abc.Lookup("a")
+	bc, _ := abc.Lookup("bc")
+	ab, _ := abc.Lookup("ab")
+	c, _ := abc.Lookup("c")
+	if m.wordKey([]ID{a, bc}) == m.wordKey([]ID{ab, c}) {
+		t.Errorf("<a><bc> and <ab><c> have the same key")
+	}
+	if m.Spell([]ID{a, bc}) != "abc" || m.Spell([]ID{ab, c}) != "abc" {
+		t.Errorf("<a><bc> and <ab><c> are not both spelled abc")
+	}
+
+	m = testModel(cmds...)
+	m.SetSpelling(SpellDedupe)
+	words = allWords(m, 2, 2)
+	if words["a bc"] && words["ab c"] {
+		t.Errorf("<a><bc> and <ab><c> were both output with dedupe")
+	}
+}
+
+// Rule weights, class weights and conditional weights are each raised to the
+// power 1/temp exactly once.
+func TestTemperature(t *testing.T) {
+	weighted := &Node{Type: Class, Left: list(
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "a"}, Right: &Node{Type: Num, Value: "9"}},
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "b"}, Right: &Node{Type: Num, Value: "1"}},
+	)}
+	tests := []struct {
+		cmds []*Node
+		want float64 // the odds of a against b at temperature 2
+	}{
+		{[]*Node{
+			production("W", 4, cvar("A")),
+			production("W", 1, cvar("B")),
+			definition("A", class("a")),
+			definition("B", class("b")),
+		}, 2},
+		{[]*Node{
+			production("W", 1, cvar("X")),
+			definition("X", class("a", "b")),
+			condition(weighted, &Node{Type: Boundary}),
+		}, 3},
+		{[]*Node{
+			production("W", 1, cvar("X")),
+			definition("X", weighted),
+		}, 3},
+		{[]*Node{
+			production("W", 1, cvar("X")),
+			definition("X", weighted),
+			condition(weighted, &Node{Type: Boundary}),
+		}, 9},
+	}
+
+	for i, test := range tests {
+		m := testModel(test.cmds...)
+		m.SetTemperature(2)
+		a, _ := m.env.Phonemes.Lookup("a")
+		b, _ := m.env.Phonemes.Lookup("b")
+		dist := m.distribution(m.parser(0), []ID{WordBoundary}, 0, 0)
+		if got := dist.Weights[a] / dist.Weights[b]; math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("test %d: odds of a = %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+// Once every word in the length range has been generated, the whole trie of
+// prefixes is marked exhausted, and Generate fails without searching again.
+func TestExhaustedPrefixes(t *testing.T) {
+	m := ngModel()
+	m.SetSpelling(SpellKeep)
+	words := generated(m, 1, 2)
+	if len(words) != 20 {
+		t.Fatalf("%d words generated, want 20", len(words))
+	}
+	if !m.explored.exhausted || m.explored.next != nil {
+		t.Errorf("the root prefix is not exhausted")
+	}
+	if word, ok := m.Generate(1, 2); ok {
+		t.Errorf("generated %q after every word was used", m.Spell(word))
+	}
+
+	// new bounds start a new trie, but the words already used stay used
+	words = generated(m, 1, 3)
+	if len(words) != 64 {
+		t.Errorf("%d words of 3 phonemes generated, want 64", len(words))
+	}
+	for word := range words {
+		if n := len(strings.Fields(word)); n != 3 {
+			t.Errorf("%q was generated again", word)
+		}
+	}
+}
+
+// Word-final conditions scale the odds of ending the word, and word-final
+// exclusions forbid it.
+func TestWordFinal(t *testing.T) {
+	boundary := &Node{Type: Boundary}
+	m := testModel(
+		production("W", 1, cvar("C"), cvar("V")),
+		production("W", 1, cvar("C"), cvar("V"), cvar("C")),
+		definition("C", class("p", "h")),
+		definition("V", class("a")),
+		&Node{Type: Exclusion, Left: list(class("h")), Right: boundary},
+	)
+	for word := range allWords(m, 0, 0) {
+		if strings.HasSuffix(word, "h") {
+			t.Errorf("%q ends in <h>", word)
+		}
+	}
+
+	// inside a class, the boundary is written as a phoneme
+	weighted := &Node{Type: Class, Left: list(
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "_"}, Right: &Node{Type: Num, Value: "2"}},
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "n"}, Right: &Node{Type: Num, Value: "1"}},
+	)}
+	m = testModel(
+		production("W", 1, cvar("C"), cvar("V")),
+		production("W", 1, cvar("C"), cvar("V"), cvar("N")),
+		definition("C", class("p")),
+		definition("V", class("a")),
+		definition("N", class("n")),
+		condition(weighted, class("a")),
+	)
+	// the syntax rules give even odds of ending after <a>, and the
+	// condition doubles them
+	words, probs := m.Best(10, 0, 0, 0)
+	if len(words) != 2 || math.Abs(probs[0]-2.0/3) > 1e-9 || math.Abs(probs[1]-1.0/3) > 1e-9 {
+		t.Errorf("probabilities %v, want [2/3 1/3]", probs)
+	}
+}
+
+// A restriction on what follows a phoneme rules out the words that would
+// break it, and nothing else.
+func TestRestriction(t *testing.T) {
+	// #N -> <m> / _ <p b>
+	restriction := &Node{
+		Type:  Restriction,
+		Value: "->",
+		Left:  list(cvar("N"), class("m")),
+		Right: &Node{Type: Context, Right: list(class("p", "b"))},
+	}
+	cmds := []*Node{
+		production("W", 1, cvar("N"), cvar("S")),
+		definition("N", class("n", "m")),
+		definition("S", class("p", "b", "a")),
+		restriction,
+	}
+	want := []string{"m p", "m b", "m a", "n a"}
+	// Best, and Generate, which backtracks out of the target
+	for _, got := range []map[string]bool{
+		allWords(testModel(cmds...), 0, 0),
+		generated(testModel(cmds...), 0, 0),
+	} {
+		if len(got) != len(want) {
+			t.Errorf("words %v, want %v", got, want)
+		}
+		for _, word := range want {
+			if !got[word] {
+				t.Errorf("%q not output", word)
+			}
+		}
+	}
+}
+
+// scoped makes the rule `in {scope}: {rule}`.
+func scoped(scope *Node, rule *Node) *Node {
+	return &Node{Type: Scope, Left: scope, Right: rule}
+}
+
+// Word-final conditions in a scope apply when the last phoneme was drawn in
+// that scope.
+func TestScopedEnding(t *testing.T) {
+	// in $Coda: <n> -> <_ *3 p n>
+	ending := &Node{Type: Class, Left: list(
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "_"}, Right: &Node{Type: Num, Value: "3"}},
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "p"}, Right: &Node{Type: Num, Value: "1"}},
+		&Node{Type: Freq, Left: &Node{Type: Phoneme, Value: "n"}, Right: &Node{Type: Num, Value: "1"}},
+	)}
+	m := testModel(
+		production("W", 1, svar("S")),
+		production("W", 1, svar("S"), svar("S")),
+		production("S", 1, cvar("C"), cvar("V"), svar("Coda")),
+		production("Coda", 1, cvar("N")),
+		definition("C", class("p", "n")),
+		definition("V", class("a")),
+		definition("N", class("n")),
+		scoped(svar("Coda"), condition(ending, class("n"))),
+	)
+	// even odds of a second syllable, tripled by the condition
+	words, probs := m.Best(1, 0, 0, 0)
+	if len(words) != 1 || math.Abs(probs[0]-3.0/8) > 1e-9 {
+		t.Errorf("most probable word has probability %v, want 3/8", probs)
+	}
+}
+
+// Explain lists the rules of each parse that a phoneme could belong to, but
+// not those of parses whose rules forbid it.
+func TestScopedExplain(t *testing.T) {
+	boundary := &Node{Type: Boundary}
+	m := testModel(
+		production("W", 1, svar("A")),
+		production("W", 1, svar("B")),
+		production("A", 1, cvar("X")),
+		production("B", 1, cvar("X")),
+		definition("X", class("p", "t")),
+		scoped(svar("A"), condition(class("p", "t"), boundary)),
+		scoped(svar("B"), &Node{Type: Exclusion, Left: list(boundary), Right: class("p")}),
+	)
+	tests := []struct {
+		phoneme string
+		rules   int
+	}{
+		{"p", 1},
+		{"t", 2},
+	}
+	for _, test := range tests {
+		k, _ := m.env.Phonemes.Lookup(test.phoneme)
+		lines := m.Explain([]ID{k})
+		if got := strings.Count(lines[0], "in $"); got != test.rules {
+			t.Errorf("Explain(%s) = %q, want %d rules", test.phoneme, lines[0], test.rules)
+		}
+	}
+}